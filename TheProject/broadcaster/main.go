@@ -0,0 +1,220 @@
+// broadcaster relays the todo events todo-backend publishes on NATS to a chat
+// webhook (Slack, Discord, Telegram or plain JSON). Replicas share a NATS
+// queue group, so every event is sent once however many are running.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// config is read from the environment, see loadConfig
+type config struct {
+	NATSURL         string
+	Subject         string
+	QueueGroup      string
+	WebhookURL      string
+	Format          string
+	TelegramChatID  string
+	Template        string
+	MaxAttempts     int
+	InitialBackoff  time.Duration
+	Workers         int
+	QueueSize       int
+	ShutdownTimeout time.Duration
+	DeadLetterFile  string
+	Port            string
+	DryRun          bool
+}
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "log the webhook messages instead of sending them")
+	flag.Parse()
+
+	setupLogger()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	cfg.DryRun = cfg.DryRun || *dryRun
+
+	sender, err := newWebhookSender(cfg)
+	if err != nil {
+		fatal("Invalid webhook configuration", err)
+	}
+
+	closed := make(chan struct{})
+	conn, err := nats.Connect(cfg.NATSURL,
+		nats.Name("broadcaster"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+		nats.DrainTimeout(30*time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("Disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", conn.ConnectedUrlRedacted())
+		}),
+		nats.ClosedHandler(func(*nats.Conn) {
+			close(closed)
+		}),
+	)
+	if err != nil {
+		fatal("Failed to connect to NATS", err)
+	}
+
+	// The callback only queues messages, WORKERS goroutines deliver them; the
+	// queue group spreads messages over the replicas
+	pool := newWorkerPool(sender, cfg.Workers, cfg.QueueSize)
+	_, err = conn.QueueSubscribe(cfg.Subject, cfg.QueueGroup, func(msg *nats.Msg) {
+		pool.Submit(msg.Subject, msg.Header.Get("X-Request-ID"), msg.Data)
+	})
+	if err != nil {
+		fatal("Failed to subscribe", err)
+	}
+
+	go serveHealth(cfg.Port, conn)
+
+	slog.Info("Broadcaster started", "subject", cfg.Subject, "queue_group", cfg.QueueGroup,
+		"format", cfg.Format, "workers", cfg.Workers, "dry_run", cfg.DryRun)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+		// Drain stops new deliveries and queues the ones already received,
+		// then the workers get until SHUTDOWN_TIMEOUT to deliver them
+		slog.Info("Shutdown signal received, draining subscription")
+		if err := conn.Drain(); err != nil {
+			slog.Warn("Failed to drain NATS connection", "error", err)
+			conn.Close()
+		}
+		<-closed
+		pool.Close(cfg.ShutdownTimeout)
+	case <-closed:
+		fatal("NATS connection closed", conn.LastError())
+	}
+
+	slog.Info("Broadcaster stopped")
+}
+
+// loadConfig reads the configuration from the environment
+func loadConfig() (config, error) {
+	cfg := config{
+		NATSURL:        getEnvOrDefault("NATS_URL", nats.DefaultURL),
+		Subject:        getEnvOrDefault("NATS_SUBJECT", "todo.created"),
+		QueueGroup:     getEnvOrDefault("NATS_QUEUE_GROUP", "broadcaster"),
+		WebhookURL:     os.Getenv("WEBHOOK_URL"),
+		Format:         getEnvOrDefault("WEBHOOK_FORMAT", "slack"),
+		TelegramChatID: os.Getenv("TELEGRAM_CHAT_ID"),
+		Template:       getEnvOrDefault("MESSAGE_TEMPLATE", defaultMessageTemplate),
+		DeadLetterFile: os.Getenv("DEAD_LETTER_FILE"),
+		Port:           getEnvOrDefault("PORT", "8081"),
+		DryRun:         os.Getenv("DRY_RUN") == "true",
+	}
+
+	maxAttempts, err := strconv.Atoi(getEnvOrDefault("MAX_ATTEMPTS", "5"))
+	if err != nil || maxAttempts < 1 {
+		return cfg, fmt.Errorf("MAX_ATTEMPTS must be a positive number")
+	}
+	cfg.MaxAttempts = maxAttempts
+
+	cfg.InitialBackoff, err = time.ParseDuration(getEnvOrDefault("INITIAL_BACKOFF", "1s"))
+	if err != nil || cfg.InitialBackoff <= 0 {
+		return cfg, fmt.Errorf("INITIAL_BACKOFF must be a positive duration such as 1s")
+	}
+
+	cfg.Workers, err = strconv.Atoi(getEnvOrDefault("WORKERS", "4"))
+	if err != nil || cfg.Workers < 1 {
+		return cfg, fmt.Errorf("WORKERS must be a positive number")
+	}
+
+	cfg.QueueSize, err = strconv.Atoi(getEnvOrDefault("QUEUE_SIZE", "100"))
+	if err != nil || cfg.QueueSize < 0 {
+		return cfg, fmt.Errorf("QUEUE_SIZE must be zero or a positive number")
+	}
+
+	cfg.ShutdownTimeout, err = time.ParseDuration(getEnvOrDefault("SHUTDOWN_TIMEOUT", "20s"))
+	if err != nil || cfg.ShutdownTimeout <= 0 {
+		return cfg, fmt.Errorf("SHUTDOWN_TIMEOUT must be a positive duration such as 20s")
+	}
+
+	return cfg, nil
+}
+
+// serveHealth answers /livez while the process runs and /readyz while it is
+// connected to NATS
+func serveHealth(port string, conn *nats.Conn) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !conn.IsConnected() {
+			http.Error(w, "Not connected to NATS", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	})
+
+	server := &http.Server{Addr: ":" + port, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		fatal("Health server failed", err)
+	}
+}
+
+// setupLogger installs a JSON slog handler honouring LOG_LEVEL, with the
+// same severity and message keys as todo-backend
+func setupLogger() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnvOrDefault("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return attr
+			}
+			switch attr.Key {
+			case slog.LevelKey:
+				attr.Key = "severity"
+				if attr.Value.Any().(slog.Level) == slog.LevelWarn {
+					attr.Value = slog.StringValue("WARNING")
+				}
+			case slog.MessageKey:
+				attr.Key = "message"
+			}
+			return attr
+		},
+	})
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Dead letters and retries would drown the test output
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+func TestLoadConfig(t *testing.T) {
+	for _, key := range []string{"MAX_ATTEMPTS", "INITIAL_BACKOFF", "WORKERS", "QUEUE_SIZE", "SHUTDOWN_TIMEOUT"} {
+		t.Setenv(key, "")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxAttempts != 5 || cfg.InitialBackoff != time.Second || cfg.Workers != 4 ||
+		cfg.QueueSize != 100 || cfg.ShutdownTimeout != 20*time.Second {
+		t.Fatalf("defaults = %+v", cfg)
+	}
+
+	tests := []struct {
+		key, value string
+	}{
+		{"MAX_ATTEMPTS", "0"},
+		{"MAX_ATTEMPTS", "many"},
+		{"INITIAL_BACKOFF", "-1s"},
+		{"WORKERS", "0"},
+		{"QUEUE_SIZE", "-1"},
+		{"SHUTDOWN_TIMEOUT", "0"},
+		{"SHUTDOWN_TIMEOUT", "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+			if _, err := loadConfig(); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultMessageTemplate renders the chat message for an event
+const defaultMessageTemplate = `{{if eq .Event "todo.created"}}New todo{{else if eq .Event "todo.deleted"}}Todo deleted{{else if eq .Event "todo.restored"}}Todo restored{{else}}Todo updated{{end}}: {{.Todo.Text}} ({{.Todo.Priority}} priority)`
+
+// maxBackoff caps the wait between two attempts
+const maxBackoff = time.Minute
+
+// Todo is the todo JSON todo-backend publishes with every event
+type Todo struct {
+	ID          int        `json:"id"`
+	Text        string     `json:"text"`
+	Priority    string     `json:"priority"`
+	Done        bool       `json:"done"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// messageData is what MESSAGE_TEMPLATE is executed with
+type messageData struct {
+	Event     string
+	RequestID string
+	Todo      Todo
+}
+
+// webhookSender turns events into webhook requests and delivers them
+type webhookSender struct {
+	cfg      config
+	template *template.Template
+	client   *http.Client
+
+	// deadLetterMu serializes appends to the dead-letter file
+	deadLetterMu sync.Mutex
+}
+
+func newWebhookSender(cfg config) (*webhookSender, error) {
+	switch cfg.Format {
+	case "slack", "discord", "generic":
+	case "telegram":
+		if cfg.TelegramChatID == "" {
+			return nil, fmt.Errorf("TELEGRAM_CHAT_ID is required for the telegram format")
+		}
+	default:
+		return nil, fmt.Errorf("unknown WEBHOOK_FORMAT %q, expected slack, discord, telegram or generic", cfg.Format)
+	}
+
+	if cfg.WebhookURL == "" && !cfg.DryRun {
+		return nil, fmt.Errorf("WEBHOOK_URL is required unless running with --dry-run")
+	}
+
+	tmpl, err := template.New("message").Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MESSAGE_TEMPLATE: %v", err)
+	}
+
+	return &webhookSender{
+		cfg:      cfg,
+		template: tmpl,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Handle delivers one event, retrying with backoff until ctx is cancelled.
+// Events that cannot be delivered end up in the dead-letter log.
+func (s *webhookSender) Handle(ctx context.Context, subject, requestID string, data []byte) {
+	logger := slog.With("subject", subject, "request_id", requestID)
+
+	var todo Todo
+	if err := json.Unmarshal(data, &todo); err != nil {
+		s.deadLetter(logger, subject, requestID, data, 0, fmt.Errorf("invalid event payload: %v", err))
+		return
+	}
+	logger = logger.With("todo_id", todo.ID)
+
+	body, err := s.render(messageData{Event: subject, RequestID: requestID, Todo: todo})
+	if err != nil {
+		s.deadLetter(logger, subject, requestID, data, 0, err)
+		return
+	}
+
+	if s.cfg.DryRun {
+		logger.Info("DRY_RUN", "format", s.cfg.Format, "body", string(body))
+		return
+	}
+
+	backoff := s.cfg.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := s.post(ctx, body)
+		if err == nil {
+			logger.Info("SENT", "attempts", attempt)
+			return
+		}
+
+		if retryAfter < 0 || attempt == s.cfg.MaxAttempts || ctx.Err() != nil {
+			s.deadLetter(logger, subject, requestID, data, attempt, err)
+			return
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		logger.Warn("RETRY", "attempt", attempt, "retry_in", wait.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			s.deadLetter(logger, subject, requestID, data, attempt, err)
+			return
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// render builds the webhook request body in the configured format
+func (s *webhookSender) render(data messageData) ([]byte, error) {
+	var text strings.Builder
+	if err := s.template.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("failed to render message: %v", err)
+	}
+
+	var payload interface{}
+	switch s.cfg.Format {
+	case "slack":
+		payload = map[string]string{"text": text.String()}
+	case "discord":
+		payload = map[string]string{"content": text.String()}
+	case "telegram":
+		payload = map[string]string{"chat_id": s.cfg.TelegramChatID, "text": text.String()}
+	default:
+		payload = map[string]interface{}{
+			"event":      data.Event,
+			"request_id": data.RequestID,
+			"message":    text.String(),
+			"todo":       data.Todo,
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// post sends body to the webhook. When it fails, retryAfter is negative if
+// retrying cannot help, the delay asked for by a Retry-After header, or zero
+// to use the normal backoff.
+func (s *webhookSender) post(ctx context.Context, body []byte) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	case resp.StatusCode >= 500:
+		return 0, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	default:
+		// Any other client error means the request itself is wrong
+		return -1, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+}
+
+// deadLetterEntry is one line of the dead-letter file
+type deadLetterEntry struct {
+	Time      time.Time       `json:"time"`
+	Subject   string          `json:"subject"`
+	RequestID string          `json:"request_id,omitempty"`
+	Attempts  int             `json:"attempts"`
+	Error     string          `json:"error"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// deadLetter records an event that could not be delivered. It is always
+// logged, and appended to DEAD_LETTER_FILE as a JSON line when configured, so
+// it can be replayed by hand.
+func (s *webhookSender) deadLetter(logger *slog.Logger, subject, requestID string, data []byte, attempts int, err error) {
+	logger.Error("DEAD_LETTER", "attempts", attempts, "error", err, "payload", string(data))
+
+	if s.cfg.DeadLetterFile == "" {
+		return
+	}
+
+	payload := json.RawMessage(data)
+	if !json.Valid(data) {
+		payload, _ = json.Marshal(string(data))
+	}
+	line, _ := json.Marshal(deadLetterEntry{
+		Time:      time.Now().UTC(),
+		Subject:   subject,
+		RequestID: requestID,
+		Attempts:  attempts,
+		Error:     err.Error(),
+		Payload:   payload,
+	})
+
+	s.deadLetterMu.Lock()
+	defer s.deadLetterMu.Unlock()
+
+	file, openErr := os.OpenFile(s.cfg.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if openErr != nil {
+		logger.Error("Failed to open dead-letter file", "error", openErr)
+		return
+	}
+	defer file.Close()
+
+	if _, writeErr := file.Write(append(line, '\n')); writeErr != nil {
+		logger.Error("Failed to write dead-letter file", "error", writeErr)
+	}
+}
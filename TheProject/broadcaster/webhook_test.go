@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSender returns a sender posting to url in format, retrying quickly and
+// dead-lettering to a file in a temporary directory
+func testSender(t *testing.T, format, url string) *webhookSender {
+	t.Helper()
+	sender, err := newWebhookSender(config{
+		WebhookURL:     url,
+		Format:         format,
+		TelegramChatID: "-100123",
+		Template:       defaultMessageTemplate,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		DeadLetterFile: filepath.Join(t.TempDir(), "dead-letter.jsonl"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+// testWebhook answers every request with the next of statuses, repeating the
+// last one, and counts the requests
+func testWebhook(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1))
+		w.WriteHeader(statuses[min(call, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+// deadLetters reads the entries in the sender's dead-letter file
+func deadLetters(t *testing.T, s *webhookSender) []deadLetterEntry {
+	t.Helper()
+	file, err := os.Open(s.cfg.DeadLetterFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []deadLetterEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry deadLetterEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("dead-letter line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRender(t *testing.T) {
+	todo := Todo{ID: 7, Text: "Learn Kubernetes", Priority: "high"}
+
+	tests := []struct {
+		format string
+		event  string
+		want   map[string]interface{}
+	}{
+		{"slack", "todo.created", map[string]interface{}{"text": "New todo: Learn Kubernetes (high priority)"}},
+		{"slack", "todo.updated", map[string]interface{}{"text": "Todo updated: Learn Kubernetes (high priority)"}},
+		{"slack", "todo.deleted", map[string]interface{}{"text": "Todo deleted: Learn Kubernetes (high priority)"}},
+		{"slack", "todo.restored", map[string]interface{}{"text": "Todo restored: Learn Kubernetes (high priority)"}},
+		{"discord", "todo.created", map[string]interface{}{"content": "New todo: Learn Kubernetes (high priority)"}},
+		{"telegram", "todo.created", map[string]interface{}{
+			"chat_id": "-100123",
+			"text":    "New todo: Learn Kubernetes (high priority)",
+		}},
+		{"generic", "todo.created", map[string]interface{}{
+			"event":      "todo.created",
+			"request_id": "req-1",
+			"message":    "New todo: Learn Kubernetes (high priority)",
+			"todo":       map[string]interface{}{"id": 7.0, "text": "Learn Kubernetes", "priority": "high", "done": false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.event, func(t *testing.T) {
+			body, err := testSender(t, tt.format, "http://webhook").render(messageData{Event: tt.event, RequestID: "req-1", Todo: todo})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("%s: %v", body, err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Fatalf("body = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestNewWebhookSenderRejectsBadConfig(t *testing.T) {
+	tests := map[string]config{
+		"unknown format":        {WebhookURL: "http://webhook", Format: "teams", Template: defaultMessageTemplate},
+		"telegram without chat": {WebhookURL: "http://webhook", Format: "telegram", Template: defaultMessageTemplate},
+		"no webhook":            {Format: "slack", Template: defaultMessageTemplate},
+		"broken template":       {WebhookURL: "http://webhook", Format: "slack", Template: "{{.Todo"},
+	}
+	for name, cfg := range tests {
+		if _, err := newWebhookSender(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestPostClassifiesStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		retryAfter     string
+		wantRetryAfter time.Duration
+		wantErr        bool
+	}{
+		{"accepted", http.StatusOK, "", 0, false},
+		{"no content", http.StatusNoContent, "", 0, false},
+		{"server error retries", http.StatusInternalServerError, "", 0, true},
+		{"unavailable retries", http.StatusServiceUnavailable, "", 0, true},
+		{"rate limited retries", http.StatusTooManyRequests, "", 0, true},
+		{"rate limited honours Retry-After", http.StatusTooManyRequests, "3", 3 * time.Second, true},
+		{"bad request gives up", http.StatusBadRequest, "", -1, true},
+		{"not found gives up", http.StatusNotFound, "", -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			retryAfter, err := testSender(t, "slack", server.URL).post(context.Background(), []byte(`{"text":"hi"}`))
+			if retryAfter != tt.wantRetryAfter || (err != nil) != tt.wantErr {
+				t.Fatalf("post = %v, %v; want %v, error %v", retryAfter, err, tt.wantRetryAfter, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleRetriesUntilSent(t *testing.T) {
+	server, calls := testWebhook(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	sender := testSender(t, "slack", server.URL)
+
+	sender.Handle(context.Background(), "todo.created", "req-1", []byte(`{"id":1,"text":"Retry me"}`))
+
+	if calls.Load() != 3 {
+		t.Fatalf("webhook called %d times, want 3", calls.Load())
+	}
+	if entries := deadLetters(t, sender); len(entries) != 0 {
+		t.Fatalf("dead letters = %+v", entries)
+	}
+}
+
+func TestHandleDeadLetters(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		data         string
+		wantCalls    int32
+		wantAttempts int
+		wantPayload  string
+	}{
+		{"gives up on client errors", http.StatusBadRequest, `{"id":1}`, 1, 1, `{"id":1}`},
+		{"gives up after max attempts", http.StatusBadGateway, `{"id":1}`, 3, 3, `{"id":1}`},
+		// Payloads that are not JSON are kept as a string
+		{"invalid payload is never sent", http.StatusOK, `not json`, 0, 0, `"not json"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := testWebhook(t, tt.status)
+			sender := testSender(t, "slack", server.URL)
+
+			sender.Handle(context.Background(), "todo.updated", "req-1", []byte(tt.data))
+
+			if calls.Load() != tt.wantCalls {
+				t.Fatalf("webhook called %d times, want %d", calls.Load(), tt.wantCalls)
+			}
+			entries := deadLetters(t, sender)
+			if len(entries) != 1 {
+				t.Fatalf("dead letters = %+v, want one", entries)
+			}
+			entry := entries[0]
+			if entry.Subject != "todo.updated" || entry.RequestID != "req-1" || entry.Attempts != tt.wantAttempts ||
+				entry.Error == "" || string(entry.Payload) != tt.wantPayload {
+				t.Fatalf("dead letter = %+v, payload %s", entry, entry.Payload)
+			}
+		})
+	}
+}
+
+func TestHandleDryRun(t *testing.T) {
+	server, calls := testWebhook(t, http.StatusOK)
+	sender := testSender(t, "slack", server.URL)
+	sender.cfg.DryRun = true
+
+	sender.Handle(context.Background(), "todo.created", "", []byte(`{"id":1,"text":"Only logged"}`))
+
+	if calls.Load() != 0 {
+		t.Fatalf("webhook called %d times in dry-run", calls.Load())
+	}
+	if entries := deadLetters(t, sender); len(entries) != 0 {
+		t.Fatalf("dead letters = %+v", entries)
+	}
+
+	// Dry-running needs no webhook at all
+	if _, err := newWebhookSender(config{Format: "slack", Template: defaultMessageTemplate, DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errQueueFull is dead-lettered for events that arrive while every worker is
+// busy and the queue is full
+var errQueueFull = errors.New("delivery queue is full")
+
+// event is a NATS message waiting for a worker
+type event struct {
+	subject   string
+	requestID string
+	data      []byte
+}
+
+// workerPool delivers events on a fixed number of goroutines, so the NATS
+// callback only has to queue them and never waits out a retry. Waiting in the
+// callback would hold up every other message and, once the client's pending
+// limits are reached, make NATS drop messages as a slow consumer.
+type workerPool struct {
+	sender *webhookSender
+	queue  chan event
+	wg     sync.WaitGroup
+
+	// ctx is cancelled when Close gives up waiting, which cuts retries short
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newWorkerPool starts workers goroutines sharing a queue of queueSize events
+func newWorkerPool(sender *webhookSender, workers, queueSize int) *workerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &workerPool{
+		sender: sender,
+		queue:  make(chan event, queueSize),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for range workers {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for ev := range p.queue {
+				p.sender.Handle(p.ctx, ev.subject, ev.requestID, ev.data)
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues an event without blocking. When the queue is full the event
+// is dead-lettered right away.
+func (p *workerPool) Submit(subject, requestID string, data []byte) {
+	select {
+	case p.queue <- event{subject: subject, requestID: requestID, data: data}:
+	default:
+		logger := slog.With("subject", subject, "request_id", requestID)
+		p.sender.deadLetter(logger, subject, requestID, data, 0, errQueueFull)
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be delivered.
+// After timeout pending retries are abandoned and dead-lettered instead. No
+// event may be submitted once Close has been called.
+func (p *workerPool) Close(timeout time.Duration) {
+	close(p.queue)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Delivery did not finish in time, dead-lettering the remaining events")
+		p.cancel()
+		<-done
+	}
+	p.cancel()
+}
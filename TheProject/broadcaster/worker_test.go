@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Submit must return at once while the workers are busy, as it runs on the
+// NATS callback
+func TestWorkerPoolSubmitDoesNotBlock(t *testing.T) {
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		received <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	sender := testSender(t, "slack", server.URL)
+	pool := newWorkerPool(sender, 1, 1)
+
+	pool.Submit("todo.created", "req-1", []byte(`{"id":1}`))
+	<-received
+
+	// The worker is stuck on the first event: the second one is queued and
+	// the third finds the queue full
+	submitted := make(chan struct{})
+	go func() {
+		pool.Submit("todo.created", "req-2", []byte(`{"id":2}`))
+		pool.Submit("todo.created", "req-3", []byte(`{"id":3}`))
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Submit blocked while the worker was busy")
+	}
+
+	close(release)
+	pool.Close(5 * time.Second)
+
+	if calls.Load() != 2 {
+		t.Fatalf("webhook called %d times, want 2", calls.Load())
+	}
+	entries := deadLetters(t, sender)
+	if len(entries) != 1 || entries[0].RequestID != "req-3" || entries[0].Error != errQueueFull.Error() {
+		t.Fatalf("dead letters = %+v, want req-3 with a full queue", entries)
+	}
+}
+
+// Close delivers what is queued, but does not wait out retries past its
+// timeout
+func TestWorkerPoolCloseAbandonsRetries(t *testing.T) {
+	server, calls := testWebhook(t, http.StatusServiceUnavailable)
+	sender := testSender(t, "slack", server.URL)
+	sender.cfg.InitialBackoff = time.Hour
+
+	pool := newWorkerPool(sender, 2, 10)
+	pool.Submit("todo.created", "req-1", []byte(`{"id":1}`))
+	for deadline := time.Now().Add(5 * time.Second); calls.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the event was never sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	pool.Close(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Close took %v", elapsed)
+	}
+
+	if calls.Load() != 1 {
+		t.Fatalf("webhook called %d times, want 1", calls.Load())
+	}
+	entries := deadLetters(t, sender)
+	if len(entries) != 1 || entries[0].RequestID != "req-1" || entries[0].Attempts != 1 {
+		t.Fatalf("dead letters = %+v, want req-1 after one attempt", entries)
+	}
+}
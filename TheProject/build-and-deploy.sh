@@ -75,6 +75,19 @@ kubectl apply -f manifests/todo-backend-service.yaml
 echo "Waiting for todo-backend to be ready..."
 kubectl wait --for=condition=available deployment/todo-backend -n project --timeout=300s
 
+# Create the API keys of the frontend and the Wikipedia cronjob on the first
+# deployment. The backend only stores their hashes, so they go into a Secret.
+if ! kubectl get secret todo-api-keys -n project > /dev/null 2>&1; then
+  echo "Creating API keys..."
+  CRONJOB_KEY=$(kubectl exec deployment/todo-backend -n project -- \
+    ./todo-backend apikey create -name wikipedia-cronjob -scopes write | tail -n 1)
+  FRONTEND_KEY=$(kubectl exec deployment/todo-backend -n project -- \
+    ./todo-backend apikey create -name todo-app -scopes read,write | tail -n 1)
+  kubectl create secret generic todo-api-keys -n project \
+    --from-literal=wikipedia-cronjob="$CRONJOB_KEY" \
+    --from-literal=todo-app="$FRONTEND_KEY"
+fi
+
 # Deploy the frontend
 echo "Deploying todo-app frontend..."
 kubectl apply -f manifests/deployment.yaml
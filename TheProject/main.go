@@ -2,14 +2,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +28,9 @@ var (
 	imageURL       string
 	cacheDuration  time.Duration
 	todoBackendURL string
+	todoPageSize   int
+	// todoBackendAPIKey authenticates the frontend's changes to the todos
+	todoBackendAPIKey string
 )
 
 func init() {
@@ -28,7 +39,8 @@ func init() {
 	imageFileName = getEnvOrDefault("IMAGE_FILENAME", "current.jpg")
 	imageURL = getEnvOrDefault("IMAGE_URL", "https://picsum.photos/1200")
 	todoBackendURL = getEnvOrDefault("TODO_BACKEND_URL", "http://todo-backend-service:3001")
-	
+	todoBackendAPIKey = os.Getenv("TODO_BACKEND_API_KEY")
+
 	// Parse cache duration from environment (in minutes)
 	cacheDurationMinutes := getEnvOrDefault("CACHE_DURATION_MINUTES", "10")
 	minutes, err := strconv.Atoi(cacheDurationMinutes)
@@ -38,6 +50,14 @@ func init() {
 	}
 	cacheDuration = time.Duration(minutes) * time.Minute
 
+	// Number of todos shown per page
+	pageSize := getEnvOrDefault("TODO_PAGE_SIZE", "20")
+	todoPageSize, err = strconv.Atoi(pageSize)
+	if err != nil || todoPageSize < 1 {
+		fmt.Printf("Invalid TODO_PAGE_SIZE: %s, using default 20\n", pageSize)
+		todoPageSize = 20
+	}
+
 	// Create image directory if it doesn't exist
 	if err := os.MkdirAll(imageDirectory, 0755); err != nil {
 		fmt.Printf("Error creating image directory: %s\n", err)
@@ -59,6 +79,7 @@ func init() {
 	fmt.Printf("  Image URL: %s\n", imageURL)
 	fmt.Printf("  Cache Duration: %v\n", cacheDuration)
 	fmt.Printf("  Todo Backend URL: %s\n", todoBackendURL)
+	fmt.Printf("  Todo Page Size: %d\n", todoPageSize)
 
 	// Start image refresh goroutine
 	go imageRefreshWorker()
@@ -74,10 +95,13 @@ func getEnvOrDefault(key, defaultValue string) string {
 
 // Todo represents a single todo item
 type Todo struct {
-	ID       int    `json:"id"`
-	Text     string `json:"text"`
-	Created  string `json:"created"`
-	Priority string `json:"priority"`
+	ID          int        `json:"id"`
+	Text        string     `json:"text"`
+	Created     string     `json:"created"`
+	Priority    string     `json:"priority"`
+	Done        bool       `json:"done"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
 }
 
 // PageData holds the data to be passed to the HTML template
@@ -88,6 +112,10 @@ type PageData struct {
 	ImagePath string
 	ImageAge  string
 	Todos     []Todo
+
+	// Paging through the todo list
+	Cursor     string
+	NextCursor string
 }
 
 // Global variable to hold the parsed template
@@ -176,29 +204,165 @@ func getImageAge() string {
 	}
 }
 
-func fetchTodosFromBackend() ([]Todo, error) {
-	resp, err := http.Get(todoBackendURL + "/todos")
+// requestIDHeader correlates log lines of the frontend and the todo-backend
+const requestIDHeader = "X-Request-ID"
+
+// requestIDFor reuses the request ID set by the client or the Ingress, or
+// generates a new one
+func requestIDFor(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// newBackendRequest builds a request to the todo-backend carrying requestID,
+// so the backend logs it with every line for that request
+func newBackendRequest(method, path string, body io.Reader, requestID string) (*http.Request, error) {
+	req, err := http.NewRequest(method, todoBackendURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(requestIDHeader, requestID)
+	setBackendAuthorization(req)
+	return req, nil
+}
+
+// setBackendAuthorization adds the frontend's API key to a request for the
+// todo-backend, which only lets anonymous callers read the public board
+func setBackendAuthorization(req *http.Request) {
+	if todoBackendAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+todoBackendAPIKey)
+	}
+}
+
+// backendRequest sends a request built by newBackendRequest
+func backendRequest(method, path string, body io.Reader, requestID string) (*http.Response, error) {
+	req, err := newBackendRequest(method, path, body, requestID)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// cachedTodoPage is a page of todos as last fetched, kept so the next page
+// view can revalidate it with If-None-Match instead of downloading it again
+type cachedTodoPage struct {
+	etag       string
+	todos      []Todo
+	nextCursor string
+}
+
+// maxCachedTodoPages bounds the page cache; it is emptied when full
+const maxCachedTodoPages = 100
+
+var (
+	todoPageCacheMu sync.Mutex
+	todoPageCache   = make(map[string]cachedTodoPage)
+)
+
+// fetchTodosFromBackend fetches one page of todos starting at cursor (empty
+// for the first page) and returns the cursor of the following page, if any.
+// Pages are cached and only downloaded again when the backend reports a
+// change.
+func fetchTodosFromBackend(cursor, requestID string) ([]Todo, string, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(todoPageSize))
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	path := "/todos?" + query.Encode()
+
+	req, err := newBackendRequest(http.MethodGet, path, nil, requestID)
+	if err != nil {
+		return getHardcodedTodos(), "", err
+	}
+
+	todoPageCacheMu.Lock()
+	cached, isCached := todoPageCache[path]
+	todoPageCacheMu.Unlock()
+	if isCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		fmt.Printf("Error fetching todos: %s\n", err)
-		return getHardcodedTodos(), err
+		fmt.Printf("Error fetching todos (request_id=%s): %s\n", requestID, err)
+		return getHardcodedTodos(), "", err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		return withCreatedTimes(cached.todos), cached.nextCursor, nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Error: received status code %d when fetching todos\n", resp.StatusCode)
-		return getHardcodedTodos(), fmt.Errorf("backend returned status %d", resp.StatusCode)
+		fmt.Printf("Error: received status code %d when fetching todos (request_id=%s)\n", resp.StatusCode, requestID)
+		return getHardcodedTodos(), "", fmt.Errorf("backend returned status %d", resp.StatusCode)
 	}
 
 	var todos []Todo
 	if err := json.NewDecoder(resp.Body).Decode(&todos); err != nil {
-		fmt.Printf("Error decoding todos JSON: %s\n", err)
-		return getHardcodedTodos(), err
+		fmt.Printf("Error decoding todos JSON (request_id=%s): %s\n", requestID, err)
+		return getHardcodedTodos(), "", err
 	}
+	nextCursor := resp.Header.Get("X-Next-Cursor")
 
-	return todos, nil
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		todoPageCacheMu.Lock()
+		if len(todoPageCache) >= maxCachedTodoPages {
+			clear(todoPageCache)
+		}
+		todoPageCache[path] = cachedTodoPage{etag: etag, todos: todos, nextCursor: nextCursor}
+		todoPageCacheMu.Unlock()
+	}
+
+	return withCreatedTimes(todos), nextCursor, nil
 }
 
-func createTodoInBackend(text, priority string) error {
+// withCreatedTimes returns a copy of todos with Created worked out again
+// from CreatedAt, which keeps cached pages from showing stale ages
+func withCreatedTimes(todos []Todo) []Todo {
+	result := make([]Todo, len(todos))
+	for i, todo := range todos {
+		if !todo.CreatedAt.IsZero() {
+			todo.Created = formatCreatedTime(todo.CreatedAt)
+		}
+		result[i] = todo
+	}
+	return result
+}
+
+// formatCreatedTime describes how long ago a todo was created, the same way
+// the backend does
+func formatCreatedTime(createdAt time.Time) string {
+	diff := time.Since(createdAt)
+
+	switch {
+	case diff < time.Minute:
+		return "just now"
+	case diff < time.Hour:
+		return plural(int(diff.Minutes()), "minute") + " ago"
+	case diff < 24*time.Hour:
+		return plural(int(diff.Hours()), "hour") + " ago"
+	default:
+		return plural(int(diff.Hours()/24), "day") + " ago"
+	}
+}
+
+func plural(count int, unit string) string {
+	if count == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
+
+func createTodoInBackend(text, priority, requestID, forwardedFor string) error {
 	payload := map[string]string{
 		"text":     text,
 		"priority": priority,
@@ -209,14 +373,125 @@ func createTodoInBackend(text, priority string) error {
 		return err
 	}
 
-	resp, err := http.Post(todoBackendURL+"/todos", "application/json", bytes.NewBuffer(jsonData))
+	req, err := newBackendRequest(http.MethodPost, "/todos", bytes.NewBuffer(jsonData), requestID)
+	if err != nil {
+		return err
+	}
+	// The backend rate limits each browser rather than the frontend as a whole
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("backend returned status %d", resp.StatusCode)
+		return readBackendProblem(resp)
+	}
+
+	return nil
+}
+
+// backendProblem is an error response of the todo-backend, which sends
+// RFC 7807 problem details with a machine readable code
+type backendProblem struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail"`
+	Rule      string `json:"rule"`
+	RequestID string `json:"request_id"`
+	// RetryAfter is the Retry-After header of a RATE_LIMITED problem
+	RetryAfter string `json:"-"`
+}
+
+func (e *backendProblem) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("backend returned status %d", e.Status)
+	}
+	return fmt.Sprintf("backend returned status %d %s: %s", e.Status, e.Code, e.Detail)
+}
+
+// readBackendProblem turns a failed backend response into a *backendProblem.
+// Bodies that are not problem details, such as those of a proxy in between,
+// leave only the status.
+func readBackendProblem(resp *http.Response) error {
+	problem := &backendProblem{Status: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After")}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/problem+json") {
+		json.NewDecoder(resp.Body).Decode(problem)
+		problem.Status = resp.StatusCode
+	}
+	return problem
+}
+
+// problemMessage is what a visitor is shown when the backend refused what
+// they did, by the problem's code. ok is false for failures that are not
+// theirs to fix.
+func problemMessage(problem *backendProblem) (message string, ok bool) {
+	switch problem.Code {
+	case "EMPTY_TEXT":
+		return "Text is required", true
+	case "TEXT_TOO_LONG":
+		return "Text must be 140 characters or less", true
+	case "MODERATION_FAILED":
+		// The backend's message names the rule without giving the list away
+		return problem.Detail, true
+	case "RATE_LIMITED":
+		return "Too many todos, please try again in " + problem.RetryAfter + " seconds", true
+	case "TODO_NOT_FOUND":
+		return "This todo no longer exists", true
+	case "UNAUTHENTICATED", "INSUFFICIENT_SCOPE":
+		return "The todo list is read only right now", true
+	default:
+		return "", false
+	}
+}
+
+// writeBackendError answers a form submission that the backend failed with
+// err, showing the visitor what went wrong where they can fix it and
+// fallback otherwise
+func writeBackendError(w http.ResponseWriter, err error, fallback string) {
+	var problem *backendProblem
+	if errors.As(err, &problem) {
+		if message, ok := problemMessage(problem); ok {
+			if problem.RetryAfter != "" {
+				w.Header().Set("Retry-After", problem.RetryAfter)
+			}
+			http.Error(w, message, problem.Status)
+			return
+		}
+	}
+	http.Error(w, fallback, http.StatusInternalServerError)
+}
+
+// forwardedFor is the X-Forwarded-For header for a request relayed to the
+// backend: the one the Ingress set, with the address it came from appended
+func forwardedFor(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		return prior + ", " + host
+	}
+	return host
+}
+
+func setTodoDoneInBackend(id int, done bool, requestID string) error {
+	// PUT marks the todo as done, DELETE marks it as not done again
+	method := http.MethodPut
+	if !done {
+		method = http.MethodDelete
+	}
+
+	resp, err := backendRequest(method, fmt.Sprintf("/todos/%d/done", id), nil, requestID)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readBackendProblem(resp)
 	}
 
 	return nil
@@ -271,8 +546,9 @@ func hello(w http.ResponseWriter, req *http.Request) {
 		userAgent = "Unknown"
 	}
 
-	// Fetch todos from backend service
-	todos, err := fetchTodosFromBackend()
+	// Fetch the requested page of todos from backend service
+	cursor := req.URL.Query().Get("cursor")
+	todos, nextCursor, err := fetchTodosFromBackend(cursor, requestIDFor(req))
 	if err != nil {
 		fmt.Printf("Using hardcoded todos due to backend error: %s\n", err)
 	}
@@ -285,6 +561,9 @@ func hello(w http.ResponseWriter, req *http.Request) {
 		ImagePath: "/image",
 		ImageAge:  getImageAge(),
 		Todos:     todos,
+
+		Cursor:     cursor,
+		NextCursor: nextCursor,
 	}
 
 	// Execute template with data
@@ -354,9 +633,46 @@ func createTodo(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Create todo in backend
-	if err := createTodoInBackend(text, priority); err != nil {
-		fmt.Printf("Error creating todo in backend: %s\n", err)
-		http.Error(w, "Failed to create todo", http.StatusInternalServerError)
+	requestID := requestIDFor(req)
+	if err := createTodoInBackend(text, priority, requestID, forwardedFor(req)); err != nil {
+		fmt.Printf("Error creating todo in backend (request_id=%s): %s\n", requestID, err)
+		writeBackendError(w, err, "Failed to create todo")
+		return
+	}
+
+	// Redirect back to main page
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+}
+
+// Handle marking a todo as done or not done
+func toggleTodoDone(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse form data
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid todo ID", http.StatusBadRequest)
+		return
+	}
+
+	done, err := strconv.ParseBool(req.FormValue("done"))
+	if err != nil {
+		http.Error(w, "done must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	requestID := requestIDFor(req)
+	if err := setTodoDoneInBackend(id, done, requestID); err != nil {
+		fmt.Printf("Error updating todo %d in backend (request_id=%s): %s\n", id, requestID, err)
+		writeBackendError(w, err, "Failed to update todo")
 		return
 	}
 
@@ -364,6 +680,73 @@ func createTodo(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, "/", http.StatusSeeOther)
 }
 
+// Relay the backend's stream of todo changes to the browser, which cannot
+// reach the backend itself
+func todoEvents(w http.ResponseWriter, req *http.Request) {
+	backendReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, todoBackendURL+"/todos/stream", nil)
+	if err != nil {
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+	requestID := requestIDFor(req)
+	backendReq.Header.Set(requestIDHeader, requestID)
+	setBackendAuthorization(backendReq)
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		backendReq.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(backendReq)
+	if err != nil {
+		fmt.Printf("Error connecting to todo stream (request_id=%s): %s\n", requestID, err)
+		http.Error(w, "Todo stream unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error: received status code %d from todo stream (request_id=%s)\n", resp.StatusCode, requestID)
+		http.Error(w, "Todo stream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Pass every chunk on as soon as it arrives
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			if flushErr := rc.Flush(); flushErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Relay WebSocket connections to the backend's collaborative editing API.
+// The Host header is passed on unchanged, so the backend's same-origin check
+// accepts browsers that loaded this page. The frontend's API key is not
+// added: browsers connect with their own session or as anonymous callers,
+// who may only change the public board when PUBLIC_BOARD allows it.
+func todoWebSocketProxy() http.Handler {
+	target, err := url.Parse(todoBackendURL)
+	if err != nil {
+		fmt.Printf("Invalid TODO_BACKEND_URL: %s\n", err)
+		os.Exit(1)
+	}
+	return httputil.NewSingleHostReverseProxy(target)
+}
+
 // Shutdown endpoint for testing container restarts
 func shutdown(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "Shutting down server for testing...\n")
@@ -378,6 +761,9 @@ func main() {
 	http.HandleFunc("/", hello)
 	http.HandleFunc("/image", serveImage)
 	http.HandleFunc("/create-todo", createTodo)
+	http.HandleFunc("/toggle-done", toggleTodoDone)
+	http.HandleFunc("/events", todoEvents)
+	http.Handle("/ws", todoWebSocketProxy())
 	http.HandleFunc("/headers", headers)
 	http.HandleFunc("/health", healthCheck)
 	http.HandleFunc("/shutdown", shutdown) // For testing container restarts
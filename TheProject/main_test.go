@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebSocketProxyDoesNotSendAPIKey(t *testing.T) {
+	var authorization []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Values("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	oldURL, oldKey := todoBackendURL, todoBackendAPIKey
+	defer func() { todoBackendURL, todoBackendAPIKey = oldURL, oldKey }()
+	todoBackendURL, todoBackendAPIKey = backend.URL, "todo_frontend-key"
+
+	rec := httptest.NewRecorder()
+	todoWebSocketProxy().ServeHTTP(rec, httptest.NewRequest("GET", "/ws", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if len(authorization) != 0 {
+		t.Fatalf("proxied /ws request carried Authorization %q", authorization)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key, so authenticate can tell keys from
+// session tokens and leaked keys are easy to search for
+const apiKeyPrefix = "tdk_"
+
+// Scopes an API key can be granted
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// apiKeyTouchInterval limits how often last_used_at is written, so a busy
+// client does not cause a database write on every request
+const apiKeyTouchInterval = time.Minute
+
+// errAPIKeyNotFound is returned by a TodoStore for unknown or revoked keys
+var errAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey lets a machine client such as the Wikipedia cronjob use the API
+// without logging in. Only the hash of the secret is stored; Prefix is its
+// first characters, to recognize the key in listings.
+type APIKey struct {
+	ID     int
+	Name   string
+	Prefix string
+	Scopes []string
+	// OwnerID is whose list the key works on, a user or publicBoard
+	OwnerID    int
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// HasScope reports whether the key was granted scope
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// newAPIKey returns a random API key
+func newAPIKey() string {
+	return apiKeyPrefix + newToken()
+}
+
+// parseScopes reads a comma separated list of scopes
+func parseScopes(value string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(value, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != scopeRead && scope != scopeWrite {
+			return nil, fmt.Errorf("unknown scope %q, expected read or write", scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// apiKeyFromContext returns the API key a request was made with, if any
+func apiKeyFromContext(ctx context.Context) (APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey).(APIKey)
+	return key, ok
+}
+
+// requiredScope is the scope a request needs: reading for safe methods,
+// writing for everything else
+func requiredScope(r *http.Request) string {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return scopeRead
+	default:
+		return scopeWrite
+	}
+}
+
+// hasScope reports whether the caller of a request may do what scope
+// allows. Logged in users may do everything on their own list, API keys
+// what they were granted, and anonymous callers what PUBLIC_BOARD allows.
+func hasScope(ctx context.Context, scope string) bool {
+	if _, ok := userFromContext(ctx); ok {
+		return true
+	}
+	if key, ok := apiKeyFromContext(ctx); ok {
+		return key.HasScope(scope)
+	}
+	return scope == scopeRead || publicBoardWritable()
+}
+
+// authenticateAPIKey is the part of authenticate handling API keys
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, token string, handler http.HandlerFunc) {
+	logger := loggerFromContext(r.Context())
+
+	key, err := store.GetAPIKey(r.Context(), hashToken(token))
+	if errors.Is(err, errAPIKeyNotFound) {
+		logger.Warn("REJECT", "reason", "invalid_api_key", "path", r.URL.Path)
+		enableCORS(w)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="todo-backend", error="invalid_token"`)
+		writeProblem(w, r, &apiError{Code: codeInvalidAPIKey, Detail: "Invalid or revoked API key"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "api_key_lookup_failed", "error", err)
+		enableCORS(w)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	logger = logger.With("api_key_id", key.ID)
+
+	if scope := requiredScope(r); !key.HasScope(scope) {
+		logger.Warn("REJECT", "reason", "insufficient_scope", "scope", scope, "path", r.URL.Path)
+		enableCORS(w)
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Bearer realm="todo-backend", error="insufficient_scope", scope="%s"`, scope))
+		writeProblem(w, r, &apiError{Code: codeInsufficientScope, Detail: "API key lacks the " + scope + " scope"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		// Only bookkeeping, the request goes on either way
+		if err := store.TouchAPIKey(r.Context(), key.ID, now); err != nil {
+			logger.Error("ERROR", "event", "api_key_touch_failed", "error", err)
+		}
+	}
+
+	ctx := context.WithValue(r.Context(), loggerKey, logger)
+	ctx = context.WithValue(ctx, apiKeyKey, key)
+	handler(w, r.WithContext(ctx))
+}
+
+// runAPIKeyCommand implements `todo-backend apikey create|list|revoke`
+func runAPIKeyCommand(args []string) error {
+	const usage = "usage: todo-backend apikey create -name NAME [-scopes read,write] [-user USERNAME] | list | revoke ID"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	s, backend, err := newStoreFromEnv()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if backend == "memory" {
+		return errors.New("API keys are kept in the database, set STORAGE_BACKEND to postgres or sqlite")
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := flags.String("name", "", "what the key is for, e.g. wikipedia-cronjob")
+		scopeList := flags.String("scopes", scopeRead+","+scopeWrite, "comma separated scopes: read, write")
+		username := flags.String("user", "", "user whose list the key works on (default: the public board)")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" || len(*name) > 64 {
+			return errors.New("-name is required and at most 64 characters")
+		}
+		scopes, err := parseScopes(*scopeList)
+		if err != nil {
+			return err
+		}
+
+		key := APIKey{Name: *name, Scopes: scopes, OwnerID: publicBoard, CreatedAt: time.Now().UTC()}
+		if *username != "" {
+			user, _, err := s.GetUserByName(ctx, *username)
+			if err != nil {
+				return fmt.Errorf("user %q: %v", *username, err)
+			}
+			key.OwnerID = user.ID
+		}
+
+		secret := newAPIKey()
+		key.Prefix = secret[:len(apiKeyPrefix)+8]
+		key, err = s.CreateAPIKey(ctx, key, hashToken(secret))
+		if err != nil {
+			return err
+		}
+
+		// The secret cannot be recovered later, only its hash is stored
+		fmt.Printf("Created API key %d (%s) with scopes %s\n", key.ID, key.Name, strings.Join(key.Scopes, ","))
+		fmt.Println(secret)
+
+	case "list":
+		keys, err := s.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-4s %-24s %-12s %-10s %-6s %-20s %s\n", "ID", "NAME", "PREFIX", "SCOPES", "OWNER", "LAST USED", "STATE")
+		for _, key := range keys {
+			lastUsed := "never"
+			if key.LastUsedAt != nil {
+				lastUsed = key.LastUsedAt.Format(time.RFC3339)
+			}
+			state := "active"
+			if key.RevokedAt != nil {
+				state = "revoked " + key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%-4d %-24s %-12s %-10s %-6d %-20s %s\n", key.ID, key.Name, key.Prefix,
+				strings.Join(key.Scopes, ","), key.OwnerID, lastUsed, state)
+		}
+
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New("usage: todo-backend apikey revoke ID")
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid API key ID: %s", args[1])
+		}
+		if err := s.RevokeAPIKey(ctx, id); err != nil {
+			return fmt.Errorf("API key %d: %v", id, err)
+		}
+		fmt.Printf("Revoked API key %d\n", id)
+
+	default:
+		return fmt.Errorf("unknown apikey command %q, expected create, list or revoke", args[0])
+	}
+
+	return nil
+}
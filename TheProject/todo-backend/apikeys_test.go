@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createAPIKey stores a key and returns its Authorization header value
+func (a *testAPI) createAPIKey(name string, owner int, scopes ...string) (APIKey, string) {
+	a.t.Helper()
+
+	secret := newAPIKey()
+	key, err := a.store.CreateAPIKey(context.Background(), APIKey{
+		Name:      name,
+		Prefix:    secret[:len(apiKeyPrefix)+8],
+		Scopes:    scopes,
+		OwnerID:   owner,
+		CreatedAt: time.Now().UTC(),
+	}, hashToken(secret))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return key, "Bearer " + secret
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	api := newTestAPI(t)
+	t.Setenv("PUBLIC_BOARD", "read")
+
+	_, reader := api.createAPIKey("dashboard", publicBoard, scopeRead)
+	_, writer := api.createAPIKey("wikipedia-cronjob", publicBoard, scopeWrite)
+
+	if rec := api.do("GET", "/todos", "", "Authorization", reader); rec.Code != http.StatusOK {
+		t.Fatalf("read key: GET status %d: %s", rec.Code, rec.Body)
+	}
+	rec := api.do("POST", "/todos", `{"text":"Not allowed"}`, "Authorization", reader)
+	expectProblem(t, rec, http.StatusForbidden, codeInsufficientScope)
+	if got := rec.Header().Get("WWW-Authenticate"); got == "" {
+		t.Fatal("403 without WWW-Authenticate")
+	}
+
+	// A write key without read cannot list what it wrote
+	todo := api.createTodo("From the cronjob", "Authorization", writer)
+	expectProblem(t, api.do("GET", "/todos", "", "Authorization", writer), http.StatusForbidden, codeInsufficientScope)
+
+	// PUBLIC_BOARD=read lets anonymous callers look but not touch
+	var todos []Todo
+	decodeBody(t, api.do("GET", "/todos", ""), &todos)
+	if len(todos) != 1 || todos[0].ID != todo.ID {
+		t.Fatalf("anonymous list = %+v", todos)
+	}
+	expectProblem(t, api.do("POST", "/todos", `{"text":"Anonymous"}`), http.StatusUnauthorized, codeUnauthenticated)
+	expectProblem(t, api.do("DELETE", "/todos/1", ""), http.StatusUnauthorized, codeUnauthenticated)
+}
+
+func TestAPIKeyOwnerAndRevocation(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.signup("alice")
+
+	var me User
+	decodeBody(t, api.do("GET", "/auth/me", "", "Authorization", alice), &me)
+	key, auth := api.createAPIKey("alice-script", me.ID, scopeRead, scopeWrite)
+
+	// The key works on its owner's list
+	todo := api.createTodo("Scripted", "Authorization", auth)
+	var todos []Todo
+	decodeBody(t, api.do("GET", "/todos", "", "Authorization", alice), &todos)
+	if len(todos) != 1 || todos[0].ID != todo.ID {
+		t.Fatalf("alice's list = %+v", todos)
+	}
+
+	if err := api.store.RevokeAPIKey(context.Background(), key.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectProblem(t, api.do("GET", "/todos", "", "Authorization", auth), http.StatusUnauthorized, codeInvalidAPIKey)
+	expectProblem(t, api.do("GET", "/todos", "", "Authorization", "Bearer "+apiKeyPrefix+"unknown"),
+		http.StatusUnauthorized, codeInvalidAPIKey)
+}
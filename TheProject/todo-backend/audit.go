@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Audit actions, one for every kind of change to a todo. Imports are
+// recorded as creates.
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	// auditPurge is the trash purger removing a todo for good
+	auditPurge = "purge"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// AuditEntry records one change to a todo: who made it, in which request,
+// and the todo as an auditSnapshot before and after. Before is null for
+// creates and After for purges. Entries are never changed or removed, not
+// even when the todo is purged from the trash.
+type AuditEntry struct {
+	ID     int64 `json:"id"`
+	TodoID int   `json:"todo_id"`
+	// OwnerID is whose list the todo is on, see TodoStore
+	OwnerID int `json:"-"`
+	// Actor is who made the change, see actorFromContext
+	Actor string `json:"actor"`
+	// ClientIP is where the change came from, empty for changes the backend
+	// made on its own
+	ClientIP  string          `json:"client_ip,omitempty"`
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	RequestID string          `json:"request_id,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// auditSnapshot is a todo as the audit log records it: the stored fields
+// with absolute times, unlike Todo whose created text is only right at the
+// time it is sent
+type auditSnapshot struct {
+	ID          int        `json:"id"`
+	Text        string     `json:"text"`
+	Priority    string     `json:"priority"`
+	Done        bool       `json:"done"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Version     int        `json:"version"`
+	// OwnerID is whose list the todo is on, 0 for the public board
+	OwnerID   int        `json:"owner_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+func newAuditSnapshot(todo *Todo) auditSnapshot {
+	return auditSnapshot{
+		ID:          todo.ID,
+		Text:        todo.Text,
+		Priority:    todo.Priority,
+		Done:        todo.Done,
+		CompletedAt: utcTime(todo.CompletedAt),
+		Version:     todo.Version,
+		OwnerID:     todo.OwnerID,
+		CreatedAt:   todo.CreatedAt.UTC(),
+		DeletedAt:   utcTime(todo.DeletedAt),
+	}
+}
+
+// utcTime returns t in UTC, or nil when t is nil
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// newAuditEntry records a change from before to after made while serving
+// ctx. Either todo may be nil, but not both.
+func newAuditEntry(ctx context.Context, action string, before, after *Todo) (AuditEntry, error) {
+	entry := AuditEntry{
+		Actor:     actorFromContext(ctx),
+		ClientIP:  clientIPFromContext(ctx),
+		Action:    action,
+		RequestID: requestIDFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+	}
+	for _, todo := range []*Todo{before, after} {
+		if todo != nil {
+			entry.TodoID, entry.OwnerID = todo.ID, todo.OwnerID
+		}
+	}
+
+	var err error
+	if before != nil {
+		if entry.Before, err = json.Marshal(newAuditSnapshot(before)); err != nil {
+			return AuditEntry{}, err
+		}
+	}
+	if after != nil {
+		if entry.After, err = json.Marshal(newAuditSnapshot(after)); err != nil {
+			return AuditEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// actorFromContext names who makes a change: the logged in user, the API
+// key, or for anonymous changes to the public board the client address.
+// Changes made outside of any request, such as purges, are the system's.
+func actorFromContext(ctx context.Context) string {
+	if user, ok := userFromContext(ctx); ok {
+		return "user:" + user.Username
+	}
+	if key, ok := apiKeyFromContext(ctx); ok {
+		return "api_key:" + key.Name
+	}
+	if ip := clientIPFromContext(ctx); ip != "" {
+		return "ip:" + ip
+	}
+	return "system"
+}
+
+// auditOptions selects the entries of a GET /audit
+type auditOptions struct {
+	// Owner is whose todos to show the history of
+	Owner int
+	// TodoID limits the entries to one todo, unless 0
+	TodoID int
+	// Since skips changes made before it, unless nil
+	Since *time.Time
+	// After is the ID of the last entry of the previous page, 0 on the
+	// first one
+	After int64
+	Limit int
+}
+
+// parseAuditOptions reads ?todo_id=&since=&limit=&cursor= from the request
+func parseAuditOptions(r *http.Request) (auditOptions, error) {
+	query := r.URL.Query()
+	opts := auditOptions{Limit: defaultAuditPageSize}
+
+	if todoIDParam := query.Get("todo_id"); todoIDParam != "" {
+		id, err := strconv.Atoi(todoIDParam)
+		if err != nil || id <= 0 {
+			return opts, fmt.Errorf("todo_id must be a positive integer")
+		}
+		opts.TodoID = id
+	}
+
+	if sinceParam := query.Get("since"); sinceParam != "" {
+		since, err := time.Parse(time.RFC3339Nano, sinceParam)
+		if err != nil {
+			return opts, fmt.Errorf("since must be an RFC 3339 timestamp")
+		}
+		since = since.UTC()
+		opts.Since = &since
+	}
+
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxAuditPageSize)
+		}
+		opts.Limit = limit
+	}
+
+	if cursorParam := query.Get("cursor"); cursorParam != "" {
+		after, err := strconv.ParseInt(cursorParam, 10, 64)
+		if err != nil || after < 0 {
+			return opts, fmt.Errorf("invalid cursor")
+		}
+		opts.After = after
+	}
+
+	return opts, nil
+}
+
+// GET /audit - Changes to the caller's todos, oldest first, optionally only
+// those of one todo and those made since a point in time. The entries name
+// users, API keys and client addresses, so anonymous visitors of the public
+// board are turned away even when PUBLIC_BOARD lets them read the todos.
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	_, isUser := userFromContext(r.Context())
+	_, isAPIKey := apiKeyFromContext(r.Context())
+	if !isUser && !isAPIKey {
+		logger.Warn("REJECT", "reason", "unauthenticated", "path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="todo-backend"`)
+		writeProblem(w, r, &apiError{Code: codeUnauthenticated, Detail: "Authentication required"})
+		return
+	}
+
+	opts, err := parseAuditOptions(r)
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_audit_options", "error", err)
+		writeProblem(w, r, &apiError{Code: codeInvalidAuditOptions, Detail: err.Error()})
+		return
+	}
+	opts.Owner = ownerFromContext(r.Context())
+
+	entries, more, err := store.AuditLog(r.Context(), opts)
+	if err != nil {
+		logger.Error("ERROR", "event", "database_query_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	// Always encode a JSON array, never null
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	if more {
+		setPaginationHeaders(w, r, strconv.FormatInt(entries[len(entries)-1].ID, 10))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(entries)
+
+	logger.Info("SUCCESS", "event", "audit_retrieved", "count", len(entries), "more", more)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestAuditRequiresCredentials(t *testing.T) {
+	for _, board := range []string{"true", "read"} {
+		t.Run("PUBLIC_BOARD="+board, func(t *testing.T) {
+			api := newTestAPI(t)
+			t.Setenv("PUBLIC_BOARD", board)
+
+			rec := api.do("GET", "/audit", "")
+			expectProblem(t, rec, http.StatusUnauthorized, codeUnauthenticated)
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Fatal("401 without WWW-Authenticate")
+			}
+
+			// An API key of the public board may read its history
+			_, key := api.createAPIKey("auditor", publicBoard, scopeRead)
+			if rec := api.do("GET", "/audit", "", "Authorization", key); rec.Code != http.StatusOK {
+				t.Fatalf("with an API key: status %d: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.signup("alice")
+	auth := []string{"Authorization", alice}
+
+	todo := api.createTodo("Audit me", auth...)
+	path := "/todos/" + strconv.Itoa(todo.ID)
+	for _, change := range [][2]string{{"PUT", path + "/done"}, {"DELETE", path}, {"POST", path + "/restore"}} {
+		rec := api.do(change[0], change[1], "", "Authorization", alice, requestIDHeader, "req-"+change[0])
+		if rec.Code >= 300 {
+			t.Fatalf("%s %s: status %d: %s", change[0], change[1], rec.Code, rec.Body)
+		}
+	}
+	other := api.createTodo("Someone else's", auth...)
+
+	var entries []AuditEntry
+	decodeBody(t, api.do("GET", "/audit?todo_id="+strconv.Itoa(todo.ID), "", auth...), &entries)
+	actions := []string{auditCreate, auditUpdate, auditDelete, auditRestore}
+	if len(entries) != len(actions) {
+		t.Fatalf("%d entries, want %d", len(entries), len(actions))
+	}
+	for i, entry := range entries {
+		if entry.Action != actions[i] || entry.TodoID != todo.ID || entry.Actor != "user:alice" || entry.ClientIP == "" {
+			t.Fatalf("entry %d = %+v, want %s by user:alice", i, entry, actions[i])
+		}
+	}
+	if string(entries[0].Before) != "null" || entries[1].RequestID != "req-PUT" {
+		t.Fatalf("create before = %s, update request_id = %q", entries[0].Before, entries[1].RequestID)
+	}
+
+	// States are the stored todo with absolute times, not the API's Todo
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(entries[2].After, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"id", "text", "priority", "done", "completed_at", "version", "owner_id", "created_at", "deleted_at"} {
+		if _, ok := snapshot[field]; !ok {
+			t.Fatalf("snapshot %s lacks %s", entries[2].After, field)
+		}
+	}
+	if _, ok := snapshot["created"]; ok {
+		t.Fatalf("snapshot %s has the relative created text", entries[2].After)
+	}
+	var deleted auditSnapshot
+	json.Unmarshal(entries[2].After, &deleted)
+	if deleted.DeletedAt == nil || deleted.CompletedAt == nil || deleted.OwnerID == publicBoard || deleted.Version != 2 {
+		t.Fatalf("deleted snapshot = %+v", deleted)
+	}
+
+	// Pages follow X-Next-Cursor
+	rec := api.do("GET", "/audit?limit=3", "", auth...)
+	decodeBody(t, rec, &entries)
+	cursor := rec.Header().Get("X-Next-Cursor")
+	if len(entries) != 3 || cursor == "" {
+		t.Fatalf("first page: %d entries, cursor %q", len(entries), cursor)
+	}
+	rec = api.do("GET", "/audit?limit=3&cursor="+cursor, "", auth...)
+	decodeBody(t, rec, &entries)
+	if len(entries) != 2 || entries[1].TodoID != other.ID || rec.Header().Get("X-Next-Cursor") != "" {
+		t.Fatalf("last page = %+v", entries)
+	}
+
+	// Other lists have their own history
+	decodeBody(t, api.do("GET", "/audit", "", "Authorization", api.signup("bob")), &entries)
+	if len(entries) != 0 {
+		t.Fatalf("bob sees %d entries of alice's list", len(entries))
+	}
+
+	for _, query := range []string{"todo_id=abc", "since=yesterday", "limit=0", "limit=1001", "cursor=-1"} {
+		expectProblem(t, api.do("GET", "/audit?"+query, "", auth...), http.StatusBadRequest, codeInvalidAuditOptions)
+	}
+}
+
+func TestStoreAuditLog(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			todo, err := s.Create(ctx, publicBoard, "Audited", "high")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Delete(ctx, publicBoard, todo.ID, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, more, err := s.AuditLog(ctx, auditOptions{Owner: publicBoard, Limit: 10})
+			if err != nil || more || len(entries) != 2 {
+				t.Fatalf("AuditLog = %d entries, %v, %v", len(entries), more, err)
+			}
+			var before, after auditSnapshot
+			if err := json.Unmarshal(entries[1].Before, &before); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(entries[1].After, &after); err != nil {
+				t.Fatal(err)
+			}
+			if entries[1].Action != auditDelete || entries[1].Actor != "system" ||
+				before.DeletedAt != nil || after.DeletedAt == nil || after.Text != "Audited" || after.Priority != "high" ||
+				!after.CreatedAt.Equal(todo.CreatedAt) {
+				t.Fatalf("delete entry %+v: before %+v, after %+v", entries[1], before, after)
+			}
+		})
+	}
+}
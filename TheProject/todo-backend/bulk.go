@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxImportBodySize bounds the body of POST /todos/import
+	maxImportBodySize = 8 << 20
+	// maxImportRows bounds how many todos one import may hold
+	maxImportRows = 10000
+)
+
+// bulkContentTypes are the formats of GET /todos/export and
+// POST /todos/import and the media types they are sent as
+var bulkContentTypes = map[string]string{
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+}
+
+// csvColumns are the columns of a CSV export. Imports find the columns by
+// the names in their header row, and only need text.
+var csvColumns = []string{"id", "text", "priority", "done", "created_at", "completed_at", "version"}
+
+// todoRecord is a todo as exported. Unlike Todo it has no human readable
+// created, only the raw timestamps, so an export can be imported elsewhere
+// without losing anything.
+type todoRecord struct {
+	ID          int        `json:"id"`
+	Text        string     `json:"text"`
+	Priority    string     `json:"priority"`
+	Done        bool       `json:"done"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Version     int        `json:"version"`
+}
+
+func newTodoRecord(todo Todo) todoRecord {
+	record := todoRecord{
+		ID:        todo.ID,
+		Text:      todo.Text,
+		Priority:  todo.Priority,
+		Done:      todo.Done,
+		CreatedAt: todo.CreatedAt.UTC(),
+		Version:   todo.Version,
+	}
+	if todo.CompletedAt != nil {
+		completedAt := todo.CompletedAt.UTC()
+		record.CompletedAt = &completedAt
+	}
+	return record
+}
+
+// csvRow returns the record's fields in the order of csvColumns
+func (rec todoRecord) csvRow() []string {
+	completedAt := ""
+	if rec.CompletedAt != nil {
+		completedAt = rec.CompletedAt.Format(time.RFC3339Nano)
+	}
+	return []string{strconv.Itoa(rec.ID), rec.Text, rec.Priority, strconv.FormatBool(rec.Done),
+		rec.CreatedAt.Format(time.RFC3339Nano), completedAt, strconv.Itoa(rec.Version)}
+}
+
+// bulkFormat picks the format of an export or import from the format query
+// parameter, falling back to fallback and then JSON
+func bulkFormat(param, fallback string) (string, error) {
+	format := param
+	if format == "" {
+		format = fallback
+	}
+	if format == "" {
+		format = "json"
+	}
+	if _, ok := bulkContentTypes[format]; !ok {
+		return "", fmt.Errorf("format must be json, csv or ndjson")
+	}
+	return format, nil
+}
+
+// formatFromContentType maps the Content-Type of an import to its format,
+// or returns "" when it names none of them
+func formatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		return "json"
+	case "application/x-ndjson", "application/ndjson":
+		return "ndjson"
+	case "text/csv":
+		return "csv"
+	default:
+		return ""
+	}
+}
+
+// exportWriter writes todo records in one of the bulk formats. Nothing is
+// written before the first record, so a failure before then can still be
+// answered with a problem.
+type exportWriter struct {
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+	count  int
+}
+
+func newExportWriter(w io.Writer, format string) *exportWriter {
+	return &exportWriter{format: format, w: w, csv: csv.NewWriter(w)}
+}
+
+func (e *exportWriter) Write(rec todoRecord) error {
+	var err error
+	switch e.format {
+	case "csv":
+		if e.count == 0 {
+			e.csv.Write(csvColumns)
+		}
+		err = e.csv.Write(rec.csvRow())
+
+	case "ndjson":
+		err = json.NewEncoder(e.w).Encode(rec)
+
+	default:
+		// A JSON array with one todo per line
+		separator := ",\n"
+		if e.count == 0 {
+			separator = "[\n"
+		}
+		var data []byte
+		if data, err = json.Marshal(rec); err == nil {
+			_, err = io.WriteString(e.w, separator+string(data))
+		}
+	}
+	e.count++
+	return err
+}
+
+// Close ends the export; it has to be called even when nothing was written
+func (e *exportWriter) Close() error {
+	switch e.format {
+	case "csv":
+		if e.count == 0 {
+			e.csv.Write(csvColumns)
+		}
+		e.csv.Flush()
+		return e.csv.Error()
+
+	case "ndjson":
+		return nil
+
+	default:
+		end := "\n]\n"
+		if e.count == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(e.w, end)
+		return err
+	}
+}
+
+// GET /todos/export?format=json|csv|ndjson - Every todo on the caller's list,
+// oldest first, streamed as it is read from the store
+func exportTodos(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	format, err := bulkFormat(r.URL.Query().Get("format"), "")
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_format", "format", r.URL.Query().Get("format"))
+		writeProblem(w, r, &apiError{Code: codeInvalidFormat, Detail: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", bulkContentTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="todos.`+format+`"`)
+	w.Header().Set("Cache-Control", "no-store")
+
+	writer := newExportWriter(w, format)
+	err = store.Export(r.Context(), ownerFromContext(r.Context()), func(todo Todo) error {
+		return writer.Write(newTodoRecord(todo))
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "todos_export_failed", "format", format, "exported", writer.count, "error", err)
+		// Once a todo was sent the status is out; the client gets a cut off body
+		if writer.count == 0 {
+			w.Header().Del("Content-Disposition")
+			writeProblem(w, r, errInternal)
+		}
+		return
+	}
+
+	logger.Info("SUCCESS", "event", "todos_exported", "format", format, "count", writer.count)
+}
+
+// importFields are the fields of one todo in an import, as text. id, version
+// and created are accepted, so exports and GET /todos pages can be imported
+// as they are, but ignored.
+type importFields struct {
+	Text        string
+	Priority    string
+	Done        bool
+	CreatedAt   string
+	CompletedAt string
+}
+
+// importRow is one todo of an import, or what is wrong with it
+type importRow struct {
+	todo Todo
+	err  *apiError
+}
+
+// importRowError is a rejected row in an importSummary. Row counts the todos
+// of the import from 1, leaving out the CSV header and blank NDJSON lines.
+type importRowError struct {
+	Row    int          `json:"row"`
+	Code   errorCode    `json:"code"`
+	Detail string       `json:"detail"`
+	Field  string       `json:"field,omitempty"`
+	Rule   string       `json:"rule,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// importSummary is the response of POST /todos/import
+type importSummary struct {
+	DryRun   bool `json:"dry_run"`
+	Total    int  `json:"total"`
+	Accepted int  `json:"accepted"`
+	Rejected int  `json:"rejected"`
+	// IDs are the IDs the accepted todos got, in the order of their rows;
+	// empty on a dry run
+	IDs    []int            `json:"ids"`
+	Errors []importRowError `json:"errors"`
+}
+
+// errTooManyRows is returned by readImportRows past maxImportRows
+var errTooManyRows = errors.New("too many todos")
+
+// POST /todos/import?format=json|csv|ndjson&dry_run=true - Add the todos of
+// an export to the caller's list. Every row is checked like POST /todos
+// checks a todo. The accepted rows are added in a single transaction, the
+// rejected ones listed in the summary; with dry_run nothing is added.
+func importTodos(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	query := r.URL.Query()
+	format, err := bulkFormat(query.Get("format"), formatFromContentType(r.Header.Get("Content-Type")))
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_format", "format", query.Get("format"))
+		writeProblem(w, r, &apiError{Code: codeInvalidFormat, Detail: err.Error()})
+		return
+	}
+
+	dryRun := false
+	if param := query.Get("dry_run"); param != "" {
+		if dryRun, err = strconv.ParseBool(param); err != nil {
+			logger.Warn("REJECT", "reason", "invalid_dry_run", "dry_run", param)
+			writeProblem(w, r, &apiError{Code: codeInvalidRequest, Detail: "dry_run must be true or false"})
+			return
+		}
+	}
+
+	rows, err := readImportRows(logger, http.MaxBytesReader(w, r.Body, maxImportBodySize), format)
+	if err != nil {
+		var problem *apiError
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &problem):
+		case errors.As(err, &tooLarge):
+			problem = &apiError{Code: codeImportTooLarge,
+				Detail: fmt.Sprintf("An import is at most %d bytes", maxImportBodySize)}
+		case errors.Is(err, errTooManyRows):
+			problem = &apiError{Code: codeImportTooLarge,
+				Detail: fmt.Sprintf("An import holds at most %d todos", maxImportRows)}
+		default:
+			problem = &apiError{Code: codeInvalidFormat, Detail: "The body is not valid " + format + ": " + err.Error()}
+		}
+		logger.Warn("REJECT", "reason", strings.ToLower(string(problem.Code)), "format", format, "error", err)
+		writeProblem(w, r, problem)
+		return
+	}
+
+	summary := importSummary{DryRun: dryRun, Total: len(rows), IDs: []int{}, Errors: []importRowError{}}
+	var accepted []Todo
+	for i, row := range rows {
+		if row.err != nil {
+			summary.Errors = append(summary.Errors, importRowError{Row: i + 1, Code: row.err.Code,
+				Detail: row.err.Detail, Field: row.err.Field, Rule: row.err.Rule, Errors: row.err.Errors})
+			continue
+		}
+		accepted = append(accepted, row.todo)
+	}
+	summary.Accepted = len(accepted)
+	summary.Rejected = len(summary.Errors)
+
+	if !dryRun && len(accepted) > 0 {
+		imported, err := store.Import(r.Context(), ownerFromContext(r.Context()), accepted)
+		if err != nil {
+			logger.Error("ERROR", "event", "database_insert_failed", "error", err)
+			writeProblem(w, r, errInternal)
+			return
+		}
+		todosImportedTotal.Add(float64(len(imported)))
+		for _, todo := range imported {
+			summary.IDs = append(summary.IDs, todo.ID)
+			publishEvent(r.Context(), eventTodoCreated, todo)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+
+	logger.Info("SUCCESS", "event", "todos_imported", "format", format, "dry_run", dryRun,
+		"total", summary.Total, "accepted", summary.Accepted, "rejected", summary.Rejected)
+}
+
+// readImportRows parses an import body in format into its rows. Problems
+// with single rows end up in the rows; errors are for bodies that cannot be
+// read at all.
+func readImportRows(logger *slog.Logger, body io.Reader, format string) ([]importRow, error) {
+	switch format {
+	case "csv":
+		return readCSVRows(logger, body)
+	case "ndjson":
+		return readNDJSONRows(logger, body)
+	default:
+		return readJSONRows(logger, body)
+	}
+}
+
+// readJSONRows reads a JSON array of todos
+func readJSONRows(logger *slog.Logger, body io.Reader) ([]importRow, error) {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+
+	invalid := func(err error) error {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return err
+		}
+		return &apiError{Code: codeInvalidJSON, Detail: "Invalid JSON: " + err.Error()}
+	}
+
+	if token, err := decoder.Token(); err != nil {
+		return nil, invalid(err)
+	} else if token != json.Delim('[') {
+		return nil, &apiError{Code: codeInvalidJSON, Detail: "A JSON import is an array of todos"}
+	}
+
+	var rows []importRow
+	for decoder.More() {
+		if len(rows) == maxImportRows {
+			return nil, errTooManyRows
+		}
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, invalid(err)
+		}
+		rows = append(rows, jsonImportRow(logger, value))
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, invalid(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, invalid(errors.New("unexpected data after the array"))
+	}
+	return rows, nil
+}
+
+// readNDJSONRows reads one JSON todo per line. A line that is not valid JSON
+// only rejects its own row.
+func readNDJSONRows(logger *slog.Logger, body io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxRequestBodySize)
+
+	var rows []importRow
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if len(rows) == maxImportRows {
+			return nil, errTooManyRows
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		var value interface{}
+		err := decoder.Decode(&value)
+		if err == nil && decoder.More() {
+			err = errors.New("unexpected data after the JSON value")
+		}
+		if err != nil {
+			rows = append(rows, importRow{err: &apiError{Code: codeInvalidJSON, Detail: "Invalid JSON: " + err.Error()}})
+			continue
+		}
+		rows = append(rows, jsonImportRow(logger, value))
+	}
+	return rows, scanner.Err()
+}
+
+// jsonImportRow checks one todo of a JSON or NDJSON import against the
+// ImportTodo schema
+func jsonImportRow(logger *slog.Logger, value interface{}) importRow {
+	if errs := schemas["ImportTodo"].validate(value, ""); len(errs) > 0 {
+		return importRow{err: &apiError{Code: codeInvalidRequest,
+			Detail: "The todo does not match the ImportTodo schema", Errors: errs}}
+	}
+
+	// The schema matched, so every field present has the right type
+	object := value.(map[string]interface{})
+	var fields importFields
+	fields.Text, _ = object["text"].(string)
+	fields.Priority, _ = object["priority"].(string)
+	fields.Done, _ = object["done"].(bool)
+	fields.CreatedAt, _ = object["created_at"].(string)
+	fields.CompletedAt, _ = object["completed_at"].(string)
+	return newImportRow(logger, fields)
+}
+
+// readCSVRows reads a CSV file with a header row, such as a CSV export
+func readCSVRows(logger *slog.Logger, body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, &apiError{Code: codeInvalidFormat, Detail: "A CSV import starts with a header row"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if i == 0 {
+			// Spreadsheets like to start files with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if !slices.Contains(csvColumns, name) {
+			return nil, &apiError{Code: codeInvalidFormat,
+				Detail: fmt.Sprintf("Unknown CSV column %q, expected some of %s", name, strings.Join(csvColumns, ", "))}
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["text"]; !ok {
+		return nil, &apiError{Code: codeInvalidFormat, Detail: "A CSV import needs a text column"}
+	}
+
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if len(rows) == maxImportRows {
+			return nil, errTooManyRows
+		}
+		if errors.Is(err, csv.ErrFieldCount) {
+			rows = append(rows, importRow{err: &apiError{Code: codeInvalidRequest,
+				Detail: fmt.Sprintf("The row has %d fields, the header %d", len(record), len(header))}})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fields := importFields{
+			Text:        column(record, "text"),
+			Priority:    column(record, "priority"),
+			CreatedAt:   column(record, "created_at"),
+			CompletedAt: column(record, "completed_at"),
+		}
+		if done := column(record, "done"); done != "" {
+			if fields.Done, err = strconv.ParseBool(done); err != nil {
+				rows = append(rows, importRow{err: &apiError{Code: codeInvalidRequest, Field: "/done",
+					Detail: "done must be true or false"}})
+				continue
+			}
+		}
+		rows = append(rows, newImportRow(logger, fields))
+	}
+	return rows, nil
+}
+
+// newImportRow applies the rules of POST /todos to one todo of an import.
+// A missing created_at is the time of the import, as is a missing
+// completed_at of a done todo.
+func newImportRow(logger *slog.Logger, fields importFields) importRow {
+	if reason, message := validateTodoText(fields.Text); reason != "" {
+		return importRow{err: &apiError{Code: codeFromReason(reason), Detail: message, Field: "/text"}}
+	}
+	if rule, message := moderation.Check(fields.Text); rule != "" {
+		return importRow{err: &apiError{Code: codeModerationFailed, Detail: message, Field: "/text", Rule: rule}}
+	}
+
+	now := time.Now().UTC()
+	todo := Todo{
+		Text:      fields.Text,
+		Priority:  normalizePriority(logger, fields.Priority),
+		Done:      fields.Done,
+		CreatedAt: now,
+	}
+
+	if fields.CreatedAt != "" {
+		createdAt, err := time.Parse(time.RFC3339Nano, fields.CreatedAt)
+		if err != nil {
+			return importRow{err: &apiError{Code: codeInvalidRequest, Field: "/created_at",
+				Detail: "created_at must be an RFC 3339 timestamp"}}
+		}
+		todo.CreatedAt = createdAt.UTC()
+	}
+
+	if todo.Done {
+		completedAt := now
+		if fields.CompletedAt != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, fields.CompletedAt)
+			if err != nil {
+				return importRow{err: &apiError{Code: codeInvalidRequest, Field: "/completed_at",
+					Detail: "completed_at must be an RFC 3339 timestamp"}}
+			}
+			completedAt = parsed.UTC()
+		}
+		todo.CompletedAt = &completedAt
+	}
+
+	return importRow{todo: todo}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "csv", "ndjson"} {
+		t.Run(format, func(t *testing.T) {
+			api := newTestAPI(t)
+			api.createTodo("Open")
+			done := api.createTodo("Finished, with a comma")
+			api.do("PUT", "/todos/"+strconv.Itoa(done.ID)+"/done", "")
+
+			rec := api.do("GET", "/todos/export?format="+format, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("export: status %d: %s", rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != bulkContentTypes[format] {
+				t.Fatalf("Content-Type = %q, want %q", ct, bulkContentTypes[format])
+			}
+			export := rec.Body.String()
+
+			// Import the export into a fresh store
+			api = newTestAPI(t)
+			rec = api.do("POST", "/todos/import", export, "Content-Type", bulkContentTypes[format])
+			var summary importSummary
+			decodeBody(t, rec, &summary)
+			if rec.Code != http.StatusOK || summary.Accepted != 2 || summary.Rejected != 0 || len(summary.IDs) != 2 {
+				t.Fatalf("import: status %d: %s", rec.Code, rec.Body)
+			}
+
+			var imported []Todo
+			if err := api.store.Export(context.Background(), publicBoard, func(todo Todo) error {
+				imported = append(imported, todo)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(imported) != 2 || imported[0].Text != "Open" || imported[0].Done ||
+				imported[1].Text != "Finished, with a comma" || !imported[1].Done || imported[1].CompletedAt == nil {
+				t.Fatalf("imported %+v", imported)
+			}
+		})
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	api := newTestAPI(t)
+
+	if body := api.do("GET", "/todos/export", "").Body.String(); body != "[]\n" {
+		t.Fatalf("empty JSON export = %q", body)
+	}
+	header, err := csv.NewReader(strings.NewReader(api.do("GET", "/todos/export?format=csv", "").Body.String())).Read()
+	if err != nil || strings.Join(header, ",") != strings.Join(csvColumns, ",") {
+		t.Fatalf("empty CSV export header = %v, %v", header, err)
+	}
+	expectProblem(t, api.do("GET", "/todos/export?format=xml", ""), http.StatusBadRequest, codeInvalidFormat)
+}
+
+func TestImportRejectsRows(t *testing.T) {
+	api := newTestAPI(t)
+
+	body := `[
+		{"text": "Fine"},
+		{"text": ""},
+		{"text": "Unknown field", "due": "today"},
+		{"text": "Bad date", "created_at": "yesterday"},
+		{"text": "` + strings.Repeat("x", maxTodoLength+1) + `"}
+	]`
+
+	rec := api.do("POST", "/todos/import?dry_run=true", body)
+	var summary importSummary
+	decodeBody(t, rec, &summary)
+	if !summary.DryRun || summary.Total != 5 || summary.Accepted != 1 || summary.Rejected != 4 || len(summary.IDs) != 0 {
+		t.Fatalf("dry run summary %+v", summary)
+	}
+	want := []struct {
+		row  int
+		code errorCode
+	}{{2, codeEmptyText}, {3, codeInvalidRequest}, {4, codeInvalidRequest}, {5, codeTextTooLong}}
+	for i, w := range want {
+		if got := summary.Errors[i]; got.Row != w.row || got.Code != w.code {
+			t.Fatalf("error %d = %+v, want row %d %s", i, got, w.row, w.code)
+		}
+	}
+	if count, _ := api.store.Count(context.Background()); count != 0 {
+		t.Fatalf("dry run stored %d todos", count)
+	}
+
+	rec = api.do("POST", "/todos/import", body)
+	decodeBody(t, rec, &summary)
+	if summary.DryRun || summary.Accepted != 1 || len(summary.IDs) != 1 {
+		t.Fatalf("import summary %+v", summary)
+	}
+	if count, _ := api.store.Count(context.Background()); count != 1 {
+		t.Fatalf("import stored %d todos, want 1", count)
+	}
+
+	// A broken NDJSON line only rejects its own row
+	rec = api.do("POST", "/todos/import?format=ndjson&dry_run=true", "{\"text\":\"a\"}\n{\"text\":\n\n{\"text\":\"b\"}\n")
+	decodeBody(t, rec, &summary)
+	if summary.Total != 3 || summary.Accepted != 2 || summary.Errors[0].Row != 2 || summary.Errors[0].Code != codeInvalidJSON {
+		t.Fatalf("ndjson summary %+v", summary)
+	}
+
+	// So does a CSV row with the wrong number of fields
+	rec = api.do("POST", "/todos/import?dry_run=true", "text,done\nFine,true\nShort\nBad,maybe\n",
+		"Content-Type", "text/csv")
+	decodeBody(t, rec, &summary)
+	if summary.Total != 3 || summary.Accepted != 1 || summary.Errors[0].Row != 2 || summary.Errors[1].Field != "/done" {
+		t.Fatalf("csv summary %+v", summary)
+	}
+}
+
+func TestImportRejectsBodies(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		name        string
+		path        string
+		body        string
+		contentType string
+		status      int
+		code        errorCode
+	}{
+		{"unknown format", "/todos/import?format=xml", `[]`, "", http.StatusBadRequest, codeInvalidFormat},
+		{"invalid dry_run", "/todos/import?dry_run=maybe", `[]`, "", http.StatusBadRequest, codeInvalidRequest},
+		{"not an array", "/todos/import", `{"text":"a"}`, "", http.StatusBadRequest, codeInvalidJSON},
+		{"broken JSON", "/todos/import", `[{"text":"a"}`, "", http.StatusBadRequest, codeInvalidJSON},
+		{"CSV without text", "/todos/import", "priority\nhigh\n", "text/csv", http.StatusBadRequest, codeInvalidFormat},
+		{"unknown CSV column", "/todos/import", "text,due\na,b\n", "text/csv", http.StatusBadRequest, codeInvalidFormat},
+		{"too many rows", "/todos/import", "[" + strings.Repeat(`{"text":"a"},`, maxImportRows) + `{"text":"a"}]`, "",
+			http.StatusRequestEntityTooLarge, codeImportTooLarge},
+		{"too large", "/todos/import?format=ndjson", strings.Repeat(`{"text":"`+strings.Repeat("x", 100)+`"}`+"\n", maxImportBodySize/100), "",
+			http.StatusRequestEntityTooLarge, codeImportTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.contentType != "" {
+				headers = []string{"Content-Type", tt.contentType}
+			}
+			expectProblem(t, api.do("POST", tt.path, tt.body, headers...), tt.status, tt.code)
+		})
+	}
+
+	if count, _ := api.store.Count(context.Background()); count != 0 {
+		t.Fatalf("%d todos stored, want none", count)
+	}
+}
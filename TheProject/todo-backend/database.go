@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// sqlDialect captures the differences between the SQL databases the backend
+// can store todos in
+type sqlDialect struct {
+	// name is the STORAGE_BACKEND value and the name reported by /stats
+	name string
+	// driver is the database/sql driver name
+	driver string
+	// migrationsDir is the directory under migrations/ holding this
+	// dialect's schema
+	migrationsDir string
+	// now is the SQL expression for the current timestamp
+	now string
+	// lockSQL and unlockSQL guard migrations against concurrent runners;
+	// empty when the database needs no explicit lock
+	lockSQL   string
+	unlockSQL string
+	// searchCondition builds the WHERE condition for a ?q= text search,
+	// using arg to bind values
+	searchCondition func(query string, arg func(interface{}) string) string
+	// timeValue converts a timestamp into a value comparable with the
+	// stored created_at column
+	timeValue func(t time.Time) interface{}
+	// skipLocked is appended to SELECTs that claim rows, so concurrent
+	// replicas claim different ones
+	skipLocked string
+	// forUpdate is appended to SELECTs reading a row that is about to
+	// change, so nobody changes it in between
+	forUpdate string
+}
+
+var postgresDialect = sqlDialect{
+	name:          "postgres",
+	driver:        "postgres",
+	migrationsDir: "postgres",
+	now:           "CURRENT_TIMESTAMP",
+	lockSQL:       fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLockKey),
+	unlockSQL:     fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockKey),
+	searchCondition: func(query string, arg func(interface{}) string) string {
+		return "to_tsvector('english', text) @@ plainto_tsquery('english', " + arg(query) + ")"
+	},
+	timeValue: func(t time.Time) interface{} {
+		return t
+	},
+	skipLocked: " FOR UPDATE SKIP LOCKED",
+	forUpdate:  " FOR UPDATE",
+}
+
+// sqliteTimeFormat matches the timestamps SQLite stores through
+// sqliteDialect.now, so cursors compare correctly against created_at
+const sqliteTimeFormat = "2006-01-02 15:04:05.000"
+
+var sqliteDialect = sqlDialect{
+	name:          "sqlite",
+	driver:        "sqlite",
+	migrationsDir: "sqlite",
+	now:           "strftime('%Y-%m-%d %H:%M:%f', 'now')",
+	// A SQLite file serves a single pod, so there is nobody to race with
+	lockSQL:   "",
+	unlockSQL: "",
+	// SQLite has no English stemming, so every search term has to appear in
+	// the text, ignoring case
+	searchCondition: func(query string, arg func(interface{}) string) string {
+		var conditions []string
+		for _, term := range strings.Fields(strings.ToLower(query)) {
+			conditions = append(conditions, "instr(lower(text), "+arg(term)+") > 0")
+		}
+		if len(conditions) == 0 {
+			return "1 = 1"
+		}
+		return "(" + strings.Join(conditions, " AND ") + ")"
+	},
+	timeValue: func(t time.Time) interface{} {
+		return t.UTC().Format(sqliteTimeFormat)
+	},
+	// A SQLite file serves a single pod, and writes are serialized anyway
+	skipLocked: "",
+	forUpdate:  "",
+}
+
+// databaseConfig works out which SQL database to use and how to reach it.
+// DATABASE_URL wins when set (postgres://... or sqlite:///path/to/todos.db),
+// otherwise STORAGE_BACKEND picks the dialect and Postgres is configured
+// through the DB_* and POSTGRES_* variables.
+func databaseConfig() (sqlDialect, string, error) {
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL != "" {
+		parsed, err := url.Parse(databaseURL)
+		if err != nil {
+			return sqlDialect{}, "", fmt.Errorf("invalid DATABASE_URL: %v", err)
+		}
+
+		switch parsed.Scheme {
+		case "postgres", "postgresql":
+			return postgresDialect, databaseURL, nil
+		case "sqlite":
+			return sqliteDialect, sqliteDSN(parsed.Host + parsed.Path), nil
+		default:
+			return sqlDialect{}, "", fmt.Errorf("unsupported DATABASE_URL scheme %q, expected postgres or sqlite", parsed.Scheme)
+		}
+	}
+
+	switch backend := getEnvOrDefault("STORAGE_BACKEND", "postgres"); backend {
+	case "postgres":
+		// Get database connection details from environment variables
+		dbHost := getEnvOrDefault("DB_HOST", "localhost")
+		dbPort := getEnvOrDefault("DB_PORT", "5432")
+		dbUser := getEnvOrDefault("POSTGRES_USER", "todouser")
+		dbPassword := getEnvOrDefault("POSTGRES_PASSWORD", "todopass123")
+		dbName := getEnvOrDefault("POSTGRES_DB", "tododb")
+		dbSSLMode := getEnvOrDefault("DB_SSLMODE", "disable")
+
+		connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+			dbHost, dbPort, dbUser, dbPassword, dbName, dbSSLMode)
+		return postgresDialect, connStr, nil
+	case "sqlite":
+		return sqliteDialect, sqliteDSN("todos.db"), nil
+	default:
+		return sqlDialect{}, "", fmt.Errorf("STORAGE_BACKEND %q is not a SQL database", backend)
+	}
+}
+
+// sqliteDSN opens the database file with a busy timeout, so concurrent
+// requests wait for each other instead of failing, and write-ahead logging
+func sqliteDSN(path string) string {
+	return "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
+// initDB connects to the configured SQL database, retrying while it starts up
+func initDB() (*sql.DB, sqlDialect, error) {
+	dialect, dsn, err := databaseConfig()
+	if err != nil {
+		return nil, dialect, err
+	}
+
+	slog.Info("Connecting to database", "dialect", dialect.name)
+
+	// Retry connection with backoff
+	var database *sql.DB
+	maxRetries := 30
+	for i := 0; i < maxRetries; i++ {
+		database, err = sql.Open(dialect.driver, dsn)
+		if err != nil {
+			slog.Warn("Failed to open database connection", "attempt", i+1, "max_attempts", maxRetries, "error", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		err = database.Ping()
+		if err != nil {
+			database.Close()
+			slog.Warn("Failed to ping database", "attempt", i+1, "max_attempts", maxRetries, "error", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		slog.Info("Successfully connected to database")
+		break
+	}
+
+	if err != nil {
+		return nil, dialect, fmt.Errorf("failed to connect to database after %d attempts: %v", maxRetries, err)
+	}
+
+	// SQLite allows a single writer, so one connection avoids lock errors
+	if dialect.name == "sqlite" {
+		database.SetMaxOpenConns(1)
+	}
+
+	return database, dialect, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Event types published when todos change. They double as the NATS subjects,
+// so consumers can subscribe to todo.> for everything.
+const (
+	eventTodoCreated = "todo.created"
+	eventTodoUpdated = "todo.updated"
+	eventTodoDeleted = "todo.deleted"
+	// eventTodoRestored carries the todo as it is back out of the trash
+	eventTodoRestored = "todo.restored"
+)
+
+// EventPublisher announces todo changes to other services. The payload of
+// every event is the todo's JSON, for todo.deleted as it was before deletion.
+type EventPublisher interface {
+	Publish(ctx context.Context, eventType string, todo Todo) error
+	Close() error
+}
+
+// events publishes todo changes, see newPublisherFromEnv
+var events EventPublisher = noopPublisher{}
+
+// newPublisherFromEnv connects to NATS when NATS_URL is set, otherwise events
+// are dropped
+func newPublisherFromEnv() (EventPublisher, error) {
+	natsURL := os.Getenv("NATS_URL")
+	if natsURL == "" {
+		slog.Info("NATS_URL not set, todo events are not published")
+		return noopPublisher{}, nil
+	}
+	return newNATSPublisher(natsURL)
+}
+
+// noopPublisher drops every event
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(ctx context.Context, eventType string, todo Todo) error {
+	return nil
+}
+
+func (noopPublisher) Close() error {
+	return nil
+}
+
+// multiPublisher publishes every event to all of its publishers
+type multiPublisher []EventPublisher
+
+func (m multiPublisher) Publish(ctx context.Context, eventType string, todo Todo) error {
+	var errs []error
+	for _, publisher := range m {
+		if err := publisher.Publish(ctx, eventType, todo); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiPublisher) Close() error {
+	var errs []error
+	for _, publisher := range m {
+		if err := publisher.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// natsPublisher publishes events as core NATS messages with the request ID
+// in an X-Request-ID header
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+// newNATSPublisher connects to the NATS server at url. The backend starts
+// even when NATS is down; the client keeps reconnecting and buffers messages
+// published in the meantime.
+func newNATSPublisher(url string) (*natsPublisher, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("todo-backend"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("Disconnected from NATS", "error", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", conn.ConnectedUrlRedacted())
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+
+	slog.Info("Publishing todo events to NATS", "connected", conn.IsConnected())
+	return &natsPublisher{conn: conn}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, eventType string, todo Todo) error {
+	// The broadcaster relays events to a shared chat, which is no place for
+	// private lists
+	if todo.OwnerID != publicBoard {
+		return nil
+	}
+
+	data, err := json.Marshal(todo)
+	if err != nil {
+		return err
+	}
+
+	// Header support is only known once connected; while NATS is unreachable
+	// the event is buffered without the request ID
+	if !p.conn.HeadersSupported() {
+		return p.conn.Publish(eventType, data)
+	}
+
+	msg := nats.NewMsg(eventType)
+	msg.Data = data
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		msg.Header.Set(requestIDHeader, requestID)
+	}
+	return p.conn.PublishMsg(msg)
+}
+
+// Close sends any buffered events before disconnecting
+func (p *natsPublisher) Close() error {
+	defer p.conn.Close()
+	if !p.conn.IsConnected() {
+		return nil
+	}
+	return p.conn.FlushTimeout(5 * time.Second)
+}
+
+// publishEvent announces a todo change. The change itself already succeeded,
+// so a failure is only logged.
+func publishEvent(ctx context.Context, eventType string, todo Todo) {
+	if err := events.Publish(ctx, eventType, todo); err != nil {
+		loggerFromContext(ctx).Error("ERROR", "event", "event_publish_failed",
+			"type", eventType, "id", todo.ID, "error", err)
+	}
+}
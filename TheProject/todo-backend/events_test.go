@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNATSPublisher(t *testing.T) {
+	server := natsserver.RunRandClientPortServer()
+	t.Cleanup(server.Shutdown)
+
+	api := newTestAPI(t)
+	publisher, err := newNATSPublisher(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+	events = publisher
+
+	conn, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	sub, err := conn.SubscribeSync("todo.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// expect reads the next event and checks its subject, request ID and todo
+	expect := func(subject, requestID string, want Todo) {
+		t.Helper()
+
+		msg, err := sub.NextMsg(5 * time.Second)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", subject, err)
+		}
+		if msg.Subject != subject {
+			t.Fatalf("subject = %s, want %s", msg.Subject, subject)
+		}
+		if got := msg.Header.Get(requestIDHeader); got != requestID {
+			t.Fatalf("%s: %s = %q, want %q", subject, requestIDHeader, got, requestID)
+		}
+		var todo Todo
+		if err := json.Unmarshal(msg.Data, &todo); err != nil {
+			t.Fatalf("%s: invalid payload %q: %v", subject, msg.Data, err)
+		}
+		if todo.ID != want.ID || todo.Text != want.Text || todo.Version != want.Version {
+			t.Fatalf("%s: payload %+v, want id %d, text %q, version %d",
+				subject, todo, want.ID, want.Text, want.Version)
+		}
+	}
+
+	rec := api.do("POST", "/todos", `{"text":"Publish me"}`, requestIDHeader, "req-create")
+	var created Todo
+	decodeBody(t, rec, &created)
+	expect(eventTodoCreated, "req-create", created)
+
+	path := "/todos/" + strconv.Itoa(created.ID)
+	rec = api.do("PATCH", path, `{"text":"Published"}`, requestIDHeader, "req-update")
+	var updated Todo
+	decodeBody(t, rec, &updated)
+	expect(eventTodoUpdated, "req-update", Todo{ID: created.ID, Text: "Published", Version: 2})
+
+	rec = api.do("DELETE", path, "", requestIDHeader, "req-delete")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+	expect(eventTodoDeleted, "req-delete", updated)
+
+	// Todos on a user's list stay private
+	auth := api.signup("alice")
+	api.createTodo("Private", "Authorization", auth)
+	if err := publisher.conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := sub.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("unexpected event %s for a private todo: %s", msg.Subject, msg.Data)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readinessTimeout bounds each readiness check, so a hanging database fails
+// the probe instead of timing it out
+const readinessTimeout = 2 * time.Second
+
+// startedAt is reported by /livez?verbose
+var startedAt = time.Now()
+
+// readinessCheck is one dependency /readyz verifies. check returns details
+// shown with ?verbose, and an error when the dependency is not usable.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) (interface{}, error)
+}
+
+// checkResult is the outcome of one readiness check in the /readyz body
+type checkResult struct {
+	Status    string      `json:"status"`
+	LatencyMs float64     `json:"latency_ms"`
+	Error     string      `json:"error,omitempty"`
+	Detail    interface{} `json:"detail,omitempty"`
+}
+
+// readinessChecks lists the checks run by /readyz, see newReadinessChecks
+var readinessChecks []readinessCheck
+
+// newReadinessChecks builds the checks for store: it must answer a ping, and
+// a SQL database must also have every migration applied and a connection
+// pool that is not exhausted
+func newReadinessChecks(store TodoStore) ([]readinessCheck, error) {
+	checks := []readinessCheck{{
+		name: "storage",
+		check: func(ctx context.Context) (interface{}, error) {
+			return map[string]string{"backend": storageBackend}, store.Ping(ctx)
+		},
+	}}
+
+	s, ok := store.(*sqlStore)
+	if !ok {
+		return checks, nil
+	}
+
+	m, err := newMigrator(s.db, s.dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	checks = append(checks, readinessCheck{
+		name: "migrations",
+		check: func(ctx context.Context) (interface{}, error) {
+			pending, err := m.Pending(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			names := []string{}
+			for _, mig := range pending {
+				names = append(names, fmt.Sprintf("%04d_%s", mig.Version, mig.Name))
+			}
+			detail := map[string]interface{}{"known": len(m.migrations), "pending": names}
+			if len(pending) > 0 {
+				return detail, fmt.Errorf("%d migrations pending", len(pending))
+			}
+			return detail, nil
+		},
+	})
+
+	// The pool counts as exhausted when every connection is in use and
+	// requests have been queueing for one since the previous check. A busy
+	// pool alone is normal, especially for SQLite's single connection.
+	var lastWaitCount atomic.Int64
+	lastWaitCount.Store(s.db.Stats().WaitCount)
+	checks = append(checks, readinessCheck{
+		name: "connection_pool",
+		check: func(ctx context.Context) (interface{}, error) {
+			stats := s.db.Stats()
+			previousWaitCount := lastWaitCount.Swap(stats.WaitCount)
+
+			detail := map[string]interface{}{
+				"open":       stats.OpenConnections,
+				"in_use":     stats.InUse,
+				"idle":       stats.Idle,
+				"max_open":   stats.MaxOpenConnections,
+				"wait_count": stats.WaitCount,
+			}
+			if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections &&
+				stats.WaitCount > previousWaitCount {
+				return detail, fmt.Errorf("all %d connections in use with requests waiting", stats.MaxOpenConnections)
+			}
+			return detail, nil
+		},
+	})
+
+	return checks, nil
+}
+
+// GET /livez - the process is up and serving HTTP. It never touches the
+// database, so a database outage does not get healthy pods restarted.
+func livenessCheck(w http.ResponseWriter, r *http.Request) {
+	body := map[string]interface{}{"status": "ok"}
+	if r.URL.Query().Has("verbose") {
+		body["uptime_seconds"] = int(time.Since(startedAt).Seconds())
+		body["storage_backend"] = storageBackend
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// GET /readyz - the pod can serve todos. Runs every readiness check and
+// answers 503 if any of them fails or the backend is shutting down. With
+// ?verbose the body includes error messages and check details.
+func readinessCheckHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	verbose := r.URL.Query().Has("verbose")
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "shutting_down"})
+		return
+	}
+
+	status := "ok"
+	results := make(map[string]checkResult, len(readinessChecks))
+
+	// Checks run one after another; SQLite only has one connection to share
+	for _, c := range readinessChecks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		start := time.Now()
+		detail, err := c.check(ctx)
+		latency := time.Since(start)
+		cancel()
+
+		result := checkResult{Status: "ok", LatencyMs: float64(latency.Microseconds()) / 1000}
+		if err != nil {
+			status = "failed"
+			result.Status = "failed"
+			logger.Warn("Readiness check failed", "check", c.name, "error", err)
+			if verbose {
+				result.Error = err.Error()
+			}
+		}
+		if verbose {
+			result.Detail = detail
+		}
+		results[c.name] = result
+	}
+
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
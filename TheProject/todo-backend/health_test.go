@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// useReadinessChecks points /readyz at the checks of a SQLite store for the
+// rest of the test, and returns the store
+func useReadinessChecks(t *testing.T) *sqlStore {
+	t.Helper()
+	s := testStores(t)["sqlite"].(*sqlStore)
+	checks, err := newReadinessChecks(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldChecks := readinessChecks
+	t.Cleanup(func() { readinessChecks = oldChecks })
+	readinessChecks = checks
+	return s
+}
+
+// healthBody is the union of the /livez and /readyz bodies
+type healthBody struct {
+	Status         string                 `json:"status"`
+	UptimeSeconds  *int                   `json:"uptime_seconds"`
+	StorageBackend *string                `json:"storage_backend"`
+	Checks         map[string]checkResult `json:"checks"`
+}
+
+func TestReadyz(t *testing.T) {
+	api := newTestAPI(t)
+	useReadinessChecks(t)
+
+	rec := api.do("GET", "/readyz", "")
+	var body healthBody
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusOK || body.Status != "ok" {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	for _, name := range []string{"storage", "migrations", "connection_pool"} {
+		if result, ok := body.Checks[name]; !ok || result.Status != "ok" || result.Detail != nil {
+			t.Fatalf("check %s = %+v", name, result)
+		}
+	}
+
+	// Details only come with ?verbose
+	decodeBody(t, api.do("GET", "/readyz?verbose", ""), &body)
+	detail, _ := body.Checks["migrations"].Detail.(map[string]interface{})
+	if pending, ok := detail["pending"].([]interface{}); !ok || len(pending) != 0 {
+		t.Fatalf("migrations detail = %+v", body.Checks["migrations"].Detail)
+	}
+}
+
+func TestHealthWithDatabaseDown(t *testing.T) {
+	api := newTestAPI(t)
+	s := useReadinessChecks(t)
+	s.db.Close()
+
+	// Liveness does not depend on the database, so the pod is not restarted
+	rec := api.do("GET", "/livez", "")
+	var body healthBody
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusOK || body.Status != "ok" || body.UptimeSeconds != nil {
+		t.Fatalf("livez: status %d: %s", rec.Code, rec.Body)
+	}
+	decodeBody(t, api.do("GET", "/livez?verbose", ""), &body)
+	if body.UptimeSeconds == nil || body.StorageBackend == nil {
+		t.Fatalf("livez?verbose = %+v", body)
+	}
+
+	rec = api.do("GET", "/readyz", "")
+	body = healthBody{}
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusServiceUnavailable || body.Status != "failed" {
+		t.Fatalf("readyz: status %d: %s", rec.Code, rec.Body)
+	}
+	if storage := body.Checks["storage"]; storage.Status != "failed" || storage.Error != "" {
+		t.Fatalf("storage check = %+v", storage)
+	}
+
+	// The reason is only shown with ?verbose
+	body = healthBody{}
+	decodeBody(t, api.do("GET", "/readyz?verbose", ""), &body)
+	if storage := body.Checks["storage"]; storage.Status != "failed" || storage.Error == "" {
+		t.Fatalf("verbose storage check = %+v", storage)
+	}
+}
+
+func TestReadyzDuringShutdown(t *testing.T) {
+	api := newTestAPI(t)
+	useReadinessChecks(t)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	shuttingDown.Store(true)
+
+	rec := api.do("GET", "/readyz", "")
+	var body healthBody
+	decodeBody(t, rec, &body)
+	if rec.Code != http.StatusServiceUnavailable || body.Status != "shutting_down" {
+		t.Fatalf("readyz: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// The process is still alive and finishing its requests
+	if rec := api.do("GET", "/livez", ""); rec.Code != http.StatusOK {
+		t.Fatalf("livez: status %d: %s", rec.Code, rec.Body)
+	}
+}
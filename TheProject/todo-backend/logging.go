@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the request ID between the frontend, the backend
+// and the client. An incoming ID is reused, otherwise a new one is generated.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client supplied request IDs
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+	// userKey holds the logged in User, see authenticate
+	userKey
+	// apiKeyKey holds the APIKey a request was made with
+	apiKeyKey
+	// clientIPKey holds the address of the client, see clientIP
+	clientIPKey
+)
+
+// setupLogger installs a JSON slog handler honouring LOG_LEVEL (debug, info,
+// warn or error) as the default logger. The level and message keys are
+// renamed to what Cloud Logging expects, so severities show up correctly.
+func setupLogger() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnvOrDefault("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) > 0 {
+				return attr
+			}
+			switch attr.Key {
+			case slog.LevelKey:
+				attr.Key = "severity"
+				if attr.Value.Any().(slog.Level) == slog.LevelWarn {
+					attr.Value = slog.StringValue("WARNING")
+				}
+			case slog.MessageKey:
+				attr.Key = "message"
+			}
+			return attr
+		},
+	})
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs err and exits, for failures the backend cannot start without
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// loggerFromContext returns the request scoped logger stored by
+// requestLogger, or the default logger outside of a request
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestIDFromContext returns the ID of the request being served, if any
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// clientIPFromContext returns the address of the client of the request
+// being served, if any
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// newRequestID returns a random 128-bit hex request ID
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID accepts short IDs made of printable ASCII without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r <= ' ' || r > '~'
+	})
+}
+
+// requestLogger wraps a handler with request logging and metrics. It assigns
+// the request ID, echoes it in the response and attaches a logger carrying it
+// to the request context, so every line logged while serving the request has it.
+func requestLogger(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID, "remote_addr", r.RemoteAddr)
+		ctx := context.WithValue(r.Context(), loggerKey, logger)
+		ctx = context.WithValue(ctx, requestIDKey, requestID)
+		ip, _ := clientIP(r)
+		ctx = context.WithValue(ctx, clientIPKey, ip)
+		r = r.WithContext(ctx)
+
+		// Log incoming request details
+		logger.Info("REQUEST START", "method", r.Method, "path", r.URL.Path,
+			"user_agent", r.Header.Get("User-Agent"))
+
+		// Create a custom ResponseWriter to capture status code
+		wrappedWriter := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		// Call the actual handler
+		handler(wrappedWriter, r)
+
+		// Log request completion
+		duration := time.Since(start)
+		logger.Info("REQUEST END", "method", r.Method, "path", r.URL.Path,
+			"status", wrappedWriter.statusCode, "duration_ms", duration.Milliseconds())
+		observeRequest(r.Pattern, r.Method, wrappedWriter.statusCode, duration)
+	}
+}
+
+// responseWriter wraps http.ResponseWriter to capture the status code
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack hands the connection over to the WebSocket handler
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
+	}
+	rw.statusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// streaming handlers need for flushing
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -1,23 +1,36 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
-
-	_ "github.com/lib/pq"
 )
 
 // Todo represents a single todo item
 type Todo struct {
-	ID       int    `json:"id"`
-	Text     string `json:"text"`
-	Created  string `json:"created"`
-	Priority string `json:"priority"`
+	ID          int        `json:"id"`
+	Text        string     `json:"text"`
+	Created     string     `json:"created"`
+	Priority    string     `json:"priority"`
+	Done        bool       `json:"done"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	// Version starts at 1 and goes up with every change
+	Version int `json:"version"`
+	// OwnerID is the user whose list the todo is on, or publicBoard
+	OwnerID int `json:"-"`
+
+	// CreatedAt is the creation time behind Created. Clients that cache todos
+	// use it to keep Created current.
+	CreatedAt time.Time `json:"created_at"`
+	// DeletedAt is set while the todo is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // CreateTodoRequest represents the request body for creating a new todo
@@ -26,166 +39,346 @@ type CreateTodoRequest struct {
 	Priority string `json:"priority,omitempty"`
 }
 
-var db *sql.DB
-
-// RequestLogger wraps http.Handler to provide comprehensive request logging
-func requestLogger(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		
-		// Log incoming request details
-		log.Printf("REQUEST START: method=%s path=%s remote_addr=%s user_agent=%s", 
-			r.Method, r.URL.Path, r.RemoteAddr, r.Header.Get("User-Agent"))
-		
-		// Create a custom ResponseWriter to capture status code
-		wrappedWriter := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		
-		// Call the actual handler
-		handler(wrappedWriter, r)
-		
-		// Log request completion
-		duration := time.Since(start)
-		log.Printf("REQUEST END: method=%s path=%s status=%d duration=%v remote_addr=%s", 
-			r.Method, r.URL.Path, wrappedWriter.statusCode, duration, r.RemoteAddr)
-	}
+// UpdateTodoRequest represents the request body for partially updating a todo.
+// Fields left out of the JSON body are not changed.
+type UpdateTodoRequest struct {
+	Text     *string `json:"text,omitempty"`
+	Priority *string `json:"priority,omitempty"`
 }
 
-// responseWriter wraps http.ResponseWriter to capture the status code
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
+// maxTodoLength is the maximum number of characters allowed in a todo
+const maxTodoLength = 140
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
+// store holds every todo, see newStoreFromEnv for the available backends
+var store TodoStore
+
+// storageBackend names the backend behind store, as reported by /stats
+var storageBackend string
 
 func main() {
-	// Initialize database connection
+	setupLogger()
+
+	// `todo-backend migrate ...` manages the schema and exits, so it can run as
+	// an init container before the server starts
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			fatal("Migration failed", err)
+		}
+		return
+	}
+
+	// `todo-backend apikey ...` manages the API keys of machine clients
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if err := runAPIKeyCommand(os.Args[2:]); err != nil {
+			fatal("API key command failed", err)
+		}
+		return
+	}
+
+	// Load the moderation rules first, a broken rule file should not wait
+	// for the database
 	var err error
-	db, err = initDB()
+	moderation, err = loadModerationFromEnv()
+	if err != nil {
+		fatal("Failed to load moderation rules", err)
+	}
+
+	publisher, err := newPublisherFromEnv()
+	if err != nil {
+		fatal("Failed to set up event publishing", err)
+	}
+	// Changes also go to the browsers following GET /todos/stream
+	keepalive, err := intervalFromEnv("STREAM_KEEPALIVE", 15*time.Second)
+	if err != nil {
+		fatal("Invalid stream configuration", err)
+	}
+	todoStream = newStreamHub(intFromEnv("STREAM_BUFFER_SIZE", 256), keepalive)
+	events = multiPublisher{publisher, todoStream}
+
+	// Initialize the todo storage
+	store, storageBackend, err = newStoreFromEnv()
+	if err != nil {
+		fatal("Failed to initialize storage", err)
+	}
+
+	registerStoreMetrics(store)
+
+	createLimiter = newRateLimiterFromEnv()
+	if createLimiter != nil {
+		registerRateLimitMetrics(createLimiter)
+	}
+
+	// Set up before serving, so a misconfigured relay stops the backend
+	var relay *outboxRelay
+	if outbox, ok := store.(outboxStore); ok && outboxEnabled() {
+		relay, err = newOutboxRelayFromEnv(outbox)
+		if err != nil {
+			fatal("Failed to set up the outbox relay", err)
+		}
+	}
+
+	purger, err := newTrashPurgerFromEnv(store)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		fatal("Failed to set up the trash purger", err)
 	}
-	defer db.Close()
 
-	// Initialize the database schema
-	if err := initSchema(); err != nil {
-		log.Fatalf("Failed to initialize database schema: %v", err)
+	readinessChecks, err = newReadinessChecks(store)
+	if err != nil {
+		fatal("Failed to set up readiness checks", err)
 	}
 
 	// Seed database with initial data if empty
-	if err := seedInitialData(); err != nil {
-		log.Printf("Warning: Failed to seed initial data: %v", err)
+	if err := seedInitialData(context.Background()); err != nil {
+		slog.Warn("Failed to seed initial data", "error", err)
+	}
+
+	registerRoutes(http.DefaultServeMux)
+
+	// Get port from environment or use default
+	port := getEnvOrDefault("PORT", "3001")
+
+	slog.Info("Todo backend starting", "port", port, "storage_backend", storageBackend)
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// Open streams never finish on their own, end them so the drain does not
+	// have to wait out SHUTDOWN_TIMEOUT
+	server.RegisterOnShutdown(func() { todoStream.Close() })
+	server.RegisterOnShutdown(closeWebSockets)
+
+	// Deliver outbox entries in the background while serving
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	if relay != nil {
+		go func() {
+			defer close(relayDone)
+			relay.Run(relayCtx)
+		}()
+	} else {
+		close(relayDone)
+	}
+
+	// Empty the trash of todos deleted longer than TRASH_RETENTION ago
+	purgerCtx, stopPurger := context.WithCancel(context.Background())
+	purgerDone := make(chan struct{})
+	if purger != nil {
+		go func() {
+			defer close(purgerDone)
+			purger.Run(purgerCtx)
+		}()
+	} else {
+		close(purgerDone)
+	}
+
+	serveErr := serve(server)
+	waitWebSockets()
+
+	stopRelay()
+	stopPurger()
+	<-relayDone
+	<-purgerDone
+
+	// Close the publisher and storage only once no request can use them
+	if err := events.Close(); err != nil {
+		slog.Warn("Failed to flush events", "error", err)
+	}
+	if err := store.Close(); err != nil {
+		slog.Warn("Failed to close storage", "error", err)
 	}
 
-	// Routes with request logging middleware
-	http.HandleFunc("/todos", requestLogger(func(w http.ResponseWriter, r *http.Request) {
+	if serveErr != nil {
+		fatal("Server failed", serveErr)
+	}
+	slog.Info("Todo backend stopped")
+}
+
+// registerRoutes adds every route of the API to mux
+func registerRoutes(mux *http.ServeMux) {
+	// Routes with request logging middleware. The todo routes work on the
+	// list of the logged in user, see authenticate.
+	mux.HandleFunc("/todos", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET", "OPTIONS":
 			getTodos(w, r)
 		case "POST":
-			createTodo(w, r)
+			rateLimit(createLimiter, createTodo)(w, r)
 		default:
-			log.Printf("REJECT: method_not_allowed method=%s path=%s remote_addr=%s", 
-				r.Method, r.URL.Path, r.RemoteAddr)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			methodNotAllowed(w, r)
 		}
-	}))
+	})))
 
-	http.HandleFunc("/health", requestLogger(healthCheck))
-	http.HandleFunc("/stats", requestLogger(getStats))
+	mux.HandleFunc("/todos/stream", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "OPTIONS":
+			streamTodos(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-	// Get port from environment or use default
-	port := getEnvOrDefault("PORT", "3001")
+	mux.HandleFunc("/todos/export", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "OPTIONS":
+			exportTodos(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-	log.Printf("Todo backend starting on port %s", port)
-	log.Printf("Database connection: %s:%s", 
-		getEnvOrDefault("DB_HOST", "localhost"),
-		getEnvOrDefault("DB_PORT", "5432"))
+	mux.HandleFunc("/todos/trash", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "OPTIONS":
+			getTrash(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
-	}
-}
+	// An import counts as one creation for the rate limit
+	mux.HandleFunc("/todos/import", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			enableCORS(w)
+			w.WriteHeader(http.StatusOK)
+		case "POST":
+			rateLimit(createLimiter, importTodos)(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-func initDB() (*sql.DB, error) {
-	// Get database connection details from environment variables
-	dbHost := getEnvOrDefault("DB_HOST", "localhost")
-	dbPort := getEnvOrDefault("DB_PORT", "5432")
-	dbUser := getEnvOrDefault("POSTGRES_USER", "todouser")
-	dbPassword := getEnvOrDefault("POSTGRES_PASSWORD", "todopass123")
-	dbName := getEnvOrDefault("POSTGRES_DB", "tododb")
-	dbSSLMode := getEnvOrDefault("DB_SSLMODE", "disable")
+	mux.HandleFunc("/todos/{id}", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "OPTIONS":
+			getTodo(w, r)
+		case "PATCH":
+			updateTodo(w, r)
+		case "DELETE":
+			deleteTodo(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-	// Connection string
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		dbHost, dbPort, dbUser, dbPassword, dbName, dbSSLMode)
+	mux.HandleFunc("/todos/{id}/done", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			enableCORS(w)
+			w.WriteHeader(http.StatusOK)
+		case "PUT":
+			setTodoDone(w, r, true)
+		case "DELETE":
+			setTodoDone(w, r, false)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-	log.Printf("Connecting to database at %s:%s", dbHost, dbPort)
+	mux.HandleFunc("/todos/{id}/restore", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			enableCORS(w)
+			w.WriteHeader(http.StatusOK)
+		case "POST":
+			restoreTodo(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-	// Retry connection with backoff
-	var database *sql.DB
-	var err error
-	maxRetries := 30
-	for i := 0; i < maxRetries; i++ {
-		database, err = sql.Open("postgres", connStr)
-		if err != nil {
-			log.Printf("Failed to open database connection (attempt %d/%d): %v", i+1, maxRetries, err)
-			time.Sleep(2 * time.Second)
-			continue
+	mux.HandleFunc("/audit", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "OPTIONS":
+			getAudit(w, r)
+		default:
+			methodNotAllowed(w, r)
 		}
+	})))
 
-		err = database.Ping()
-		if err != nil {
-			log.Printf("Failed to ping database (attempt %d/%d): %v", i+1, maxRetries, err)
-			time.Sleep(2 * time.Second)
-			continue
+	mux.HandleFunc("GET /ws", requestLogger(authenticate(serveWebSocket)))
+
+	mux.HandleFunc("/auth/signup", requestLogger(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			enableCORS(w)
+			w.WriteHeader(http.StatusOK)
+		case "POST":
+			signup(w, r)
+		default:
+			methodNotAllowed(w, r)
 		}
+	}))
 
-		log.Println("Successfully connected to database")
-		break
-	}
+	mux.HandleFunc("/auth/login", requestLogger(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			enableCORS(w)
+			w.WriteHeader(http.StatusOK)
+		case "POST":
+			login(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	}))
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to database after %d attempts: %v", maxRetries, err)
-	}
+	mux.HandleFunc("/auth/logout", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			enableCORS(w)
+			w.WriteHeader(http.StatusOK)
+		case "POST":
+			logout(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
 
-	return database, nil
+	mux.HandleFunc("/auth/me", requestLogger(authenticate(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "OPTIONS":
+			currentUser(w, r)
+		default:
+			methodNotAllowed(w, r)
+		}
+	})))
+
+	mux.HandleFunc("GET /openapi.json", requestLogger(serveOpenAPI))
+
+	mux.HandleFunc("/livez", requestLogger(livenessCheck))
+	mux.HandleFunc("/readyz", requestLogger(readinessCheckHandler))
+	mux.HandleFunc("/health", requestLogger(healthCheck))
+	mux.HandleFunc("/stats", requestLogger(getStats))
+
+	// Scraped every few seconds, so kept out of the request logs
+	mux.Handle("/metrics", metricsHandler())
 }
 
-func initSchema() error {
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS todos (
-		id SERIAL PRIMARY KEY,
-		text TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		priority VARCHAR(10) DEFAULT 'medium'
-	);
-	
-	CREATE INDEX IF NOT EXISTS idx_todos_created_at ON todos(created_at DESC);
-	`
-
-	_, err := db.Exec(createTableSQL)
+func migrateSchema(db *sql.DB, dialect sqlDialect) error {
+	m, err := newMigrator(db, dialect)
 	if err != nil {
-		return fmt.Errorf("failed to create table: %v", err)
+		return err
 	}
 
-	log.Println("Database schema initialized")
+	applied, err := m.Up(context.Background())
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Database schema up to date", "applied", applied)
 	return nil
 }
 
-func seedInitialData() error {
+func seedInitialData(ctx context.Context) error {
 	// Check if we already have data
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM todos").Scan(&count)
+	count, err := store.Count(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to check existing data: %v", err)
 	}
 
 	if count > 0 {
-		log.Printf("Database already has %d todos, skipping seed", count)
+		slog.Info("Database already has todos, skipping seed", "count", count)
 		return nil
 	}
 
@@ -203,16 +396,12 @@ func seedInitialData() error {
 	}
 
 	for _, todo := range initialTodos {
-		_, err := db.Exec(
-			"INSERT INTO todos (text, priority) VALUES ($1, $2)",
-			todo.text, todo.priority,
-		)
-		if err != nil {
+		if _, err := store.Create(ctx, publicBoard, todo.text, todo.priority); err != nil {
 			return fmt.Errorf("failed to insert initial todo: %v", err)
 		}
 	}
 
-	log.Printf("Seeded database with %d initial todos", len(initialTodos))
+	slog.Info("Seeded database with initial todos", "count", len(initialTodos))
 	return nil
 }
 
@@ -254,12 +443,15 @@ func formatCreatedTime(createdAt time.Time) string {
 // CORS middleware
 func enableCORS(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-None-Match, "+requestIDHeader)
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, "+requestIDHeader)
 }
 
 // GET /todos - Get all todos
 func getTodos(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
 	enableCORS(w)
 
 	if r.Method == "OPTIONS" {
@@ -267,43 +459,59 @@ func getTodos(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query("SELECT id, text, created_at, priority FROM todos ORDER BY created_at DESC")
+	opts, err := parseListOptions(r)
 	if err != nil {
-		log.Printf("Error querying todos: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Warn("REJECT", "reason", "invalid_list_options", "error", err)
+		writeProblem(w, r, &apiError{Code: codeInvalidListOptions, Detail: err.Error()})
 		return
 	}
-	defer rows.Close()
+	opts.Owner = ownerFromContext(r.Context())
 
-	var todos []Todo
-	for rows.Next() {
-		var todo Todo
-		var createdAt time.Time
-		
-		err := rows.Scan(&todo.ID, &todo.Text, &createdAt, &todo.Priority)
-		if err != nil {
-			log.Printf("Error scanning todo: %v", err)
-			continue
-		}
-		
-		todo.Created = formatCreatedTime(createdAt)
-		todos = append(todos, todo)
+	// Taken before listing, so a change made in between only costs the
+	// client an extra download next time
+	state, err := store.State(r.Context(), opts.Owner)
+	if err != nil {
+		logger.Error("ERROR", "event", "database_query_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
 	}
 
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating todos: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	etag := listETag(opts.Owner, state, r.URL.Query())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		logger.Info("SUCCESS", "event", "todos_not_modified", "etag", etag)
 		return
 	}
 
+	todos, next, err := store.List(r.Context(), opts)
+	if err != nil {
+		logger.Error("ERROR", "event", "database_query_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	if next != nil {
+		setPaginationHeaders(w, r, encodeCursor(*next))
+	}
+
+	// Always encode a JSON array, never null
+	if todos == nil {
+		todos = []Todo{}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(todos)
 
-	log.Printf("SUCCESS: todos_retrieved count=%d remote_addr=%s", len(todos), r.RemoteAddr)
+	logger.Info("SUCCESS", "event", "todos_retrieved", "count", len(todos),
+		"sort", opts.Sort, "order", opts.Order, "query", opts.Query)
 }
 
 // POST /todos - Create a new todo
 func createTodo(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
 	enableCORS(w)
 
 	if r.Method == "OPTIONS" {
@@ -312,78 +520,281 @@ func createTodo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method != "POST" {
-		log.Printf("REJECT: invalid_method method=%s path=%s remote_addr=%s", 
-			r.Method, r.URL.Path, r.RemoteAddr)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
 
 	var req CreateTodoRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("REJECT: invalid_json error=%s remote_addr=%s", err.Error(), r.RemoteAddr)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if reason := decodeRequest(w, r, "CreateTodoRequest", &req); reason != "" {
+		todosRejectedTotal.WithLabelValues(reason).Inc()
 		return
 	}
 
-	log.Printf("TODO_REQUEST: text_length=%d priority=%s remote_addr=%s text_preview=%.50s", 
-		len(req.Text), req.Priority, r.RemoteAddr, req.Text)
+	logger.Info("TODO_REQUEST", "text_length", len(req.Text), "priority", req.Priority,
+		"text_preview", textPreview(req.Text))
 
 	// Validate the request
-	if req.Text == "" {
-		log.Printf("REJECT: empty_text remote_addr=%s", r.RemoteAddr)
-		http.Error(w, "Text is required", http.StatusBadRequest)
+	if reason, message := validateTodoText(req.Text); reason != "" {
+		logger.Warn("REJECT", "reason", reason, "length", len(req.Text), "max", maxTodoLength,
+			"text_preview", textPreview(req.Text))
+		todosRejectedTotal.WithLabelValues(reason).Inc()
+		writeProblem(w, r, &apiError{Code: codeFromReason(reason), Detail: message, Field: "/text"})
+		return
+	}
+
+	if rule, message := moderation.Check(req.Text); rule != "" {
+		logger.Warn("REJECT", "reason", "moderation", "moderation_rule", rule,
+			"text_preview", textPreview(req.Text))
+		todosRejectedTotal.WithLabelValues("moderation").Inc()
+		writeProblem(w, r, &apiError{Code: codeModerationFailed, Detail: message, Field: "/text", Rule: rule})
+		return
+	}
+
+	req.Priority = normalizePriority(logger, req.Priority)
+
+	// Insert into database
+	newTodo, err := store.Create(r.Context(), ownerFromContext(r.Context()), req.Text, req.Priority)
+	if err != nil {
+		logger.Error("ERROR", "event", "database_insert_failed", "error", err)
+		writeProblem(w, r, errInternal)
 		return
 	}
 
-	if len(req.Text) > 140 {
-		log.Printf("REJECT: text_too_long length=%d max=140 remote_addr=%s text_preview=%.50s", 
-			len(req.Text), r.RemoteAddr, req.Text)
-		http.Error(w, "Text must be 140 characters or less", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newTodo)
+	todosCreatedTotal.Inc()
+	publishEvent(r.Context(), eventTodoCreated, newTodo)
+
+	logger.Info("SUCCESS", "event", "todo_created", "id", newTodo.ID, "text_length", len(newTodo.Text),
+		"priority", newTodo.Priority, "text", textPreview(newTodo.Text))
+}
+
+// GET /todos/{id} - Get a single todo
+func getTodo(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	// Set default priority if not provided
-	if req.Priority == "" {
-		req.Priority = "medium"
+	id, err := parseTodoID(r)
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_id", "id", r.PathValue("id"))
+		writeProblem(w, r, &apiError{Code: codeInvalidID, Detail: "Invalid todo ID"})
+		return
 	}
 
-	// Validate priority
-	if req.Priority != "low" && req.Priority != "medium" && req.Priority != "high" {
-		log.Printf("WARN: invalid_priority priority=%s remote_addr=%s, setting to medium", 
-			req.Priority, r.RemoteAddr)
-		req.Priority = "medium"
+	todo, err := store.Get(r.Context(), ownerFromContext(r.Context()), id)
+	if errors.Is(err, errTodoNotFound) {
+		logger.Warn("REJECT", "reason", "todo_not_found", "id", id)
+		writeProblem(w, r, &apiError{Code: codeTodoNotFound, Detail: "Todo not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "database_query_failed", "id", id, "error", err)
+		writeProblem(w, r, errInternal)
+		return
 	}
 
-	// Insert into database
-	var newTodo Todo
-	var createdAt time.Time
-	err := db.QueryRow(
-		"INSERT INTO todos (text, priority) VALUES ($1, $2) RETURNING id, text, created_at, priority",
-		req.Text, req.Priority,
-	).Scan(&newTodo.ID, &newTodo.Text, &createdAt, &newTodo.Priority)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(todo)
+
+	logger.Info("SUCCESS", "event", "todo_retrieved", "id", todo.ID)
+}
+
+// PATCH /todos/{id} - Update the text and/or priority of a todo
+func updateTodo(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
 
+	enableCORS(w)
+
+	id, err := parseTodoID(r)
 	if err != nil {
-		log.Printf("ERROR: database_insert_failed error=%s remote_addr=%s", err.Error(), r.RemoteAddr)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Warn("REJECT", "reason", "invalid_id", "id", r.PathValue("id"))
+		writeProblem(w, r, &apiError{Code: codeInvalidID, Detail: "Invalid todo ID"})
+		return
+	}
+
+	// The schema requires at least one of the fields
+	var req UpdateTodoRequest
+	if reason := decodeRequest(w, r, "UpdateTodoRequest", &req); reason != "" {
 		return
 	}
 
-	newTodo.Created = formatCreatedTime(createdAt)
+	if req.Text != nil {
+		if reason, message := validateTodoText(*req.Text); reason != "" {
+			logger.Warn("REJECT", "reason", reason, "id", id, "length", len(*req.Text),
+				"max", maxTodoLength, "text_preview", textPreview(*req.Text))
+			writeProblem(w, r, &apiError{Code: codeFromReason(reason), Detail: message, Field: "/text"})
+			return
+		}
+
+		if rule, message := moderation.Check(*req.Text); rule != "" {
+			logger.Warn("REJECT", "reason", "moderation", "moderation_rule", rule, "id", id,
+				"text_preview", textPreview(*req.Text))
+			writeProblem(w, r, &apiError{Code: codeModerationFailed, Detail: message, Field: "/text", Rule: rule})
+			return
+		}
+	}
+
+	if req.Priority != nil {
+		priority := normalizePriority(logger, *req.Priority)
+		req.Priority = &priority
+	}
+
+	todo, err := store.Update(r.Context(), ownerFromContext(r.Context()), id, TodoUpdate{Text: req.Text, Priority: req.Priority})
+	if errors.Is(err, errTodoNotFound) {
+		logger.Warn("REJECT", "reason", "todo_not_found", "id", id)
+		writeProblem(w, r, &apiError{Code: codeTodoNotFound, Detail: "Todo not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "database_update_failed", "id", id, "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(newTodo)
+	json.NewEncoder(w).Encode(todo)
+	publishEvent(r.Context(), eventTodoUpdated, todo)
+
+	logger.Info("SUCCESS", "event", "todo_updated", "id", todo.ID, "text_length", len(todo.Text),
+		"priority", todo.Priority, "text", textPreview(todo.Text))
+}
+
+// PUT /todos/{id}/done marks a todo as done, DELETE /todos/{id}/done undoes it
+func setTodoDone(w http.ResponseWriter, r *http.Request, done bool) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	id, err := parseTodoID(r)
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_id", "id", r.PathValue("id"))
+		writeProblem(w, r, &apiError{Code: codeInvalidID, Detail: "Invalid todo ID"})
+		return
+	}
+
+	// Marking an already completed todo as done keeps its original completed_at
+	todo, err := store.Update(r.Context(), ownerFromContext(r.Context()), id, TodoUpdate{Done: &done})
+	if errors.Is(err, errTodoNotFound) {
+		logger.Warn("REJECT", "reason", "todo_not_found", "id", id)
+		writeProblem(w, r, &apiError{Code: codeTodoNotFound, Detail: "Todo not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "database_update_failed", "id", id, "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
 
-	log.Printf("SUCCESS: todo_created id=%d text_length=%d priority=%s remote_addr=%s text=%.50s", 
-		newTodo.ID, len(newTodo.Text), newTodo.Priority, r.RemoteAddr, newTodo.Text)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(todo)
+	publishEvent(r.Context(), eventTodoUpdated, todo)
+
+	logger.Info("SUCCESS", "event", "todo_done_changed", "id", todo.ID, "done", todo.Done)
 }
 
-// Health check endpoint
+// DELETE /todos/{id} - Delete a todo
+func deleteTodo(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	id, err := parseTodoID(r)
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_id", "id", r.PathValue("id"))
+		writeProblem(w, r, &apiError{Code: codeInvalidID, Detail: "Invalid todo ID"})
+		return
+	}
+
+	todo, err := store.Delete(r.Context(), ownerFromContext(r.Context()), id, nil)
+	if errors.Is(err, errTodoNotFound) {
+		logger.Warn("REJECT", "reason", "todo_not_found", "id", id)
+		writeProblem(w, r, &apiError{Code: codeTodoNotFound, Detail: "Todo not found"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "database_delete_failed", "id", id, "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	publishEvent(r.Context(), eventTodoDeleted, todo)
+
+	logger.Info("SUCCESS", "event", "todo_deleted", "id", id)
+}
+
+// methodNotAllowed rejects a request whose method the route does not support
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	loggerFromContext(r.Context()).Warn("REJECT", "reason", "method_not_allowed",
+		"method", r.Method, "path", r.URL.Path)
+	writeProblem(w, r, &apiError{Code: codeMethodNotAllowed, Detail: r.Method + " is not supported on " + r.URL.Path})
+}
+
+// textPreview shortens todo text to 50 characters for log lines, cutting
+// between characters so the logs stay valid UTF-8
+func textPreview(text string) string {
+	if runes := []rune(text); len(runes) > 50 {
+		return string(runes[:50])
+	}
+	return text
+}
+
+// parseTodoID reads the {id} path segment of /todos/{id}
+func parseTodoID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid todo id %q", r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// validateTodoText applies the rules every todo text must satisfy. On failure
+// it returns the reason used in log lines and the message sent to the client.
+func validateTodoText(text string) (reason, message string) {
+	if text == "" {
+		return "empty_text", "Text is required"
+	}
+	if len(text) > maxTodoLength {
+		return "text_too_long", fmt.Sprintf("Text must be %d characters or less", maxTodoLength)
+	}
+	return "", ""
+}
+
+// normalizePriority defaults a missing priority to medium and falls back to
+// medium for anything other than low, medium or high.
+func normalizePriority(logger *slog.Logger, priority string) string {
+	if priority == "" {
+		return "medium"
+	}
+	if priority != "low" && priority != "medium" && priority != "high" {
+		logger.Warn("Invalid priority, using medium", "priority", priority)
+		return "medium"
+	}
+	return priority
+}
+
+// Health check endpoint, kept for existing clients. Probes should use /livez
+// and /readyz instead.
 func healthCheck(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	// Fail readiness while draining, so no new requests are routed here
+	if shuttingDown.Load() {
+		writeProblem(w, r, &apiError{Code: codeUnavailable, Detail: "Shutting down"})
+		return
+	}
+
 	// Check database connection
-	if err := db.Ping(); err != nil {
-		log.Printf("Health check failed - database error: %v", err)
-		http.Error(w, "Database connection failed", http.StatusServiceUnavailable)
+	if err := store.Ping(r.Context()); err != nil {
+		logger.Error("Health check failed - database error", "error", err)
+		writeProblem(w, r, &apiError{Code: codeUnavailable, Detail: "Database connection failed"})
 		return
 	}
 
@@ -393,23 +804,23 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 
 // Stats endpoint for debugging
 func getStats(w http.ResponseWriter, r *http.Request) {
-	var totalTodos int
-	err := db.QueryRow("SELECT COUNT(*) FROM todos").Scan(&totalTodos)
+	logger := loggerFromContext(r.Context())
+
+	totalTodos, err := store.Count(r.Context())
 	if err != nil {
-		log.Printf("Error getting stats: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger.Error("ERROR", "event", "stats_query_failed", "error", err)
+		writeProblem(w, r, errInternal)
 		return
 	}
 
 	stats := map[string]interface{}{
 		"total_todos": totalTodos,
 		"timestamp":   time.Now().Format(time.RFC3339),
-		"database":    "postgres",
+		"database":    storageBackend,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 
-	log.Printf("SUCCESS: stats_retrieved total_todos=%d remote_addr=%s", totalTodos, r.RemoteAddr)
+	logger.Info("SUCCESS", "event", "stats_retrieved", "total_todos", totalTodos)
 }
-
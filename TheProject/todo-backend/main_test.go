@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestMain(m *testing.M) {
+	// Request logs would drown the test output
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testAPI serves the routes of the backend against a fresh memoryStore
+type testAPI struct {
+	t     *testing.T
+	mux   *http.ServeMux
+	store *memoryStore
+}
+
+// newTestAPI swaps the package level store, publisher, moderation and rate
+// limiter for test ones and puts them back when the test ends. The public
+// board is writable without logging in, unless the test sets PUBLIC_BOARD.
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+
+	oldStore, oldEvents, oldModeration, oldLimiter := store, events, moderation, createLimiter
+	t.Cleanup(func() {
+		store, events, moderation, createLimiter = oldStore, oldEvents, oldModeration, oldLimiter
+	})
+
+	s := newMemoryStore()
+	store = s
+	events = noopPublisher{}
+	moderation = nil
+	createLimiter = nil
+	t.Setenv("PUBLIC_BOARD", "true")
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	return &testAPI{t: t, mux: mux, store: s}
+}
+
+// do sends a request with an optional JSON body and header pairs
+func (a *testAPI) do(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	a.t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// signup creates an account and returns its Authorization header value
+func (a *testAPI) signup(username string) string {
+	a.t.Helper()
+
+	rec := a.do("POST", "/auth/signup", `{"username":"`+username+`","password":"password1"}`)
+	if rec.Code != http.StatusCreated {
+		a.t.Fatalf("signup %s: status %d: %s", username, rec.Code, rec.Body)
+	}
+	var session SessionResponse
+	decodeBody(a.t, rec, &session)
+	return "Bearer " + session.Token
+}
+
+// createTodo adds a todo through the API and returns it
+func (a *testAPI) createTodo(text string, headers ...string) Todo {
+	a.t.Helper()
+
+	rec := a.do("POST", "/todos", `{"text":"`+text+`"}`, headers...)
+	if rec.Code != http.StatusCreated {
+		a.t.Fatalf("create %q: status %d: %s", text, rec.Code, rec.Body)
+	}
+	var todo Todo
+	decodeBody(a.t, rec, &todo)
+	return todo
+}
+
+// decodeBody unmarshals a JSON response
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder, dst interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), dst); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rec.Body, err)
+	}
+}
+
+// expectProblem checks that a response is a problem with the given status
+// and code
+func expectProblem(t *testing.T, rec *httptest.ResponseRecorder, status int, code errorCode) Problem {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Content-Type = %q, want application/problem+json", ct)
+	}
+	var problem Problem
+	decodeBody(t, rec, &problem)
+	if problem.Code != code {
+		t.Fatalf("code = %s, want %s: %s", problem.Code, code, rec.Body)
+	}
+	return problem
+}
+
+func TestCreateAndListTodos(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := api.do("POST", "/todos", `{"text":"Write tests","priority":"high"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	var created Todo
+	decodeBody(t, rec, &created)
+	if created.ID == 0 || created.Text != "Write tests" || created.Priority != "high" || created.Version != 1 {
+		t.Fatalf("unexpected todo %+v", created)
+	}
+
+	// Anything but low, medium and high is stored as medium
+	rec = api.do("POST", "/todos", `{"text":"Second","priority":"urgent"}`)
+	var second Todo
+	decodeBody(t, rec, &second)
+	if second.Priority != "medium" {
+		t.Fatalf("priority = %q, want medium", second.Priority)
+	}
+
+	rec = api.do("GET", "/todos", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: status %d: %s", rec.Code, rec.Body)
+	}
+	var todos []Todo
+	decodeBody(t, rec, &todos)
+	if len(todos) != 2 || todos[0].ID != second.ID || todos[1].ID != created.ID {
+		t.Fatalf("list = %+v, want the two todos newest first", todos)
+	}
+
+	rec = api.do("GET", "/todos/"+strconv.Itoa(created.ID), "")
+	var got Todo
+	decodeBody(t, rec, &got)
+	if rec.Code != http.StatusOK || got.Text != "Write tests" {
+		t.Fatalf("get: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestListTodosEmpty(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := api.do("GET", "/todos", "")
+	if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+		t.Fatalf("empty list = %s, want []", body)
+	}
+}
+
+func TestCreateTodoValidation(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   errorCode
+	}{
+		{"invalid JSON", `{"text":`, http.StatusBadRequest, codeInvalidJSON},
+		{"missing text", `{}`, http.StatusBadRequest, codeInvalidRequest},
+		{"unknown field", `{"text":"a","due":"today"}`, http.StatusBadRequest, codeInvalidRequest},
+		{"empty text", `{"text":""}`, http.StatusBadRequest, codeEmptyText},
+		{"text too long", `{"text":"` + strings.Repeat("x", maxTodoLength+1) + `"}`, http.StatusBadRequest, codeTextTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectProblem(t, api.do("POST", "/todos", tt.body), tt.status, tt.code)
+		})
+	}
+
+	if count, _ := api.store.Count(context.Background()); count != 0 {
+		t.Fatalf("%d todos stored, want none", count)
+	}
+}
+
+func TestGetTodoErrors(t *testing.T) {
+	api := newTestAPI(t)
+
+	expectProblem(t, api.do("GET", "/todos/abc", ""), http.StatusBadRequest, codeInvalidID)
+	expectProblem(t, api.do("GET", "/todos/42", ""), http.StatusNotFound, codeTodoNotFound)
+	expectProblem(t, api.do("PUT", "/todos", ""), http.StatusMethodNotAllowed, codeMethodNotAllowed)
+}
+
+func TestTextPreview(t *testing.T) {
+	if got := textPreview("short"); got != "short" {
+		t.Fatalf("textPreview(short) = %q", got)
+	}
+
+	// Multi-byte characters are never cut in half
+	text := strings.Repeat("ä", 60)
+	got := textPreview(text)
+	if !utf8.ValidString(got) || utf8.RuneCountInString(got) != 50 {
+		t.Fatalf("textPreview = %q, want the first 50 characters", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// rejectReasons are the todo rejection reasons exported with a zero count
+// from startup, so dashboards and alerts see them before the first rejection
+var rejectReasons = []string{"empty_text", "text_too_long", "invalid_json", "invalid_request", "moderation"}
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_backend_http_requests_total",
+		Help: "HTTP requests served, by route pattern, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "todo_backend_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route pattern, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	todosCreatedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_backend_todos_created_total",
+		Help: "Todos created through POST /todos and the WebSocket API.",
+	})
+
+	todosImportedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_backend_todos_imported_total",
+		Help: "Todos added through POST /todos/import.",
+	})
+
+	todosPurgedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "todo_backend_todos_purged_total",
+		Help: "Deleted todos removed for good from the trash after TRASH_RETENTION.",
+	})
+
+	todosRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_backend_todos_rejected_total",
+		Help: "Todos rejected by POST /todos and the WebSocket API, by rejection reason.",
+	}, []string{"reason"})
+
+	websocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "todo_backend_websocket_connections",
+		Help: "Open connections to the /ws WebSocket API.",
+	})
+
+	outboxDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_backend_outbox_deliveries_total",
+		Help: "Outbox webhook delivery attempts, by result (sent or failed).",
+	}, []string{"result"})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "todo_backend_rate_limited_total",
+		Help: "Todo creations rejected by the rate limiter, by kind of client (user, api_key or ip).",
+	}, []string{"client"})
+)
+
+func init() {
+	for _, reason := range rejectReasons {
+		todosRejectedTotal.WithLabelValues(reason)
+	}
+	outboxDeliveriesTotal.WithLabelValues("sent")
+	outboxDeliveriesTotal.WithLabelValues("failed")
+	for _, kind := range []string{"user", "api_key", "ip"} {
+		rateLimitedTotal.WithLabelValues(kind)
+	}
+}
+
+// registerRateLimitMetrics exports how many clients limiter is tracking
+func registerRateLimitMetrics(limiter *rateLimiter) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "todo_backend_rate_limit_clients",
+		Help: "Clients with a partly used rate limit bucket for todo creation.",
+	}, func() float64 {
+		return float64(limiter.Clients())
+	})
+}
+
+// registerStoreMetrics exports the number of todos in store and, for the SQL
+// backends, the connection pool statistics of its database
+func registerStoreMetrics(store TodoStore) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "todo_backend_todos",
+		Help: "Todos currently stored.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		count, err := store.Count(ctx)
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(count)
+	})
+
+	if s, ok := store.(*sqlStore); ok {
+		prometheus.MustRegister(collectors.NewDBStatsCollector(s.db, s.dialect.name))
+	}
+}
+
+// metricsHandler serves every registered metric in the Prometheus text format
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// observeRequest records a served request. route is the pattern the request
+// matched rather than its path, so IDs do not create a series per todo.
+func observeRequest(route, method string, status int, duration time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	labels := []string{route, method, strconv.Itoa(status)}
+	httpRequestsTotal.WithLabelValues(labels...).Inc()
+	httpRequestDuration.WithLabelValues(labels...).Observe(duration.Seconds())
+}
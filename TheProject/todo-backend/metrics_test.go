@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// requestSeries returns the labels of every series of a request metric
+func requestSeries(t *testing.T, collector prometheus.Collector) []map[string]string {
+	t.Helper()
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(metrics)
+		close(metrics)
+	}()
+
+	var series []map[string]string
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		labels := make(map[string]string)
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		series = append(series, labels)
+	}
+	return series
+}
+
+// histogramCount returns how many observations a histogram series holds
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := observer.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRequestMetrics(t *testing.T) {
+	api := newTestAPI(t)
+	todo := api.createTodo("Count me")
+	path := "/todos/" + strconv.Itoa(todo.ID)
+
+	counter := httpRequestsTotal.WithLabelValues("/todos/{id}", "GET", "200")
+	histogram := httpRequestDuration.WithLabelValues("/todos/{id}", "GET", "200")
+	notFound := httpRequestsTotal.WithLabelValues("/todos/{id}", "GET", "404")
+	requests, observations, misses := testutil.ToFloat64(counter), histogramCount(t, histogram), testutil.ToFloat64(notFound)
+
+	if rec := api.do("GET", path, ""); rec.Code != http.StatusOK {
+		t.Fatalf("get: status %d: %s", rec.Code, rec.Body)
+	}
+	api.do("GET", "/todos/987654", "")
+
+	if got := testutil.ToFloat64(counter) - requests; got != 1 {
+		t.Fatalf("counted %v requests, want 1", got)
+	}
+	if got := histogramCount(t, histogram) - observations; got != 1 {
+		t.Fatalf("observed %d durations, want 1", got)
+	}
+	if got := testutil.ToFloat64(notFound) - misses; got != 1 {
+		t.Fatalf("counted %v not found requests, want 1", got)
+	}
+
+	// Routes are labelled with the pattern, never the path with its ID
+	for _, collector := range []prometheus.Collector{httpRequestsTotal, httpRequestDuration} {
+		for _, labels := range requestSeries(t, collector) {
+			if labels["route"] == path || labels["route"] == "/todos/987654" {
+				t.Fatalf("series labelled with the path: %v", labels)
+			}
+		}
+	}
+}
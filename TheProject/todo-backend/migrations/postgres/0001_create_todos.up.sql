@@ -0,0 +1,9 @@
+-- IF NOT EXISTS keeps this safe for databases created before migrations existed
+CREATE TABLE IF NOT EXISTS todos (
+    id SERIAL PRIMARY KEY,
+    text TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    priority VARCHAR(10) DEFAULT 'medium'
+);
+
+CREATE INDEX IF NOT EXISTS idx_todos_created_at ON todos(created_at DESC);
@@ -0,0 +1,5 @@
+-- Backs the ?q= full-text search on GET /todos
+CREATE INDEX IF NOT EXISTS idx_todos_text_search ON todos USING GIN (to_tsvector('english', text));
+
+-- Keyset pagination orders by (created_at, id)
+CREATE INDEX IF NOT EXISTS idx_todos_created_at_id ON todos(created_at DESC, id DESC);
@@ -0,0 +1,2 @@
+-- version is bumped by every change, so writers can detect concurrent edits
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,15 @@
+-- Keys for machine clients such as the Wikipedia cronjob. Only the SHA-256
+-- hash of a key is stored; key_prefix is kept to recognize keys in listings.
+-- scopes is a comma separated list of read and write. Keys without an owner
+-- work on the public board.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    key_prefix TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
@@ -0,0 +1,5 @@
+-- Deleted todos stay in the trash until the purger removes them for good.
+-- Every query on the list skips rows with deleted_at set.
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_todos_deleted_at ON todos (deleted_at) WHERE deleted_at IS NOT NULL;
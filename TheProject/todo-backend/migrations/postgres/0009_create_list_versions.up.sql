@@ -0,0 +1,7 @@
+-- The version of every todo list, raised in the same transaction as every
+-- create, update, delete, restore and import on it, so GET /todos can tell
+-- whether a list changed. owner_id is 0 for the public board.
+CREATE TABLE IF NOT EXISTS list_versions (
+    owner_id INTEGER PRIMARY KEY,
+    version BIGINT NOT NULL
+);
@@ -0,0 +1,29 @@
+-- Every change to a todo, with who made it and the todo before and after as
+-- JSON. Rows are written in the same transaction as the change. todo_id and
+-- owner_id declare no foreign keys, so the history outlives purged todos.
+-- Times are UTC and set by the backend.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    todo_id INTEGER NOT NULL,
+    owner_id INTEGER,
+    actor TEXT NOT NULL,
+    client_ip TEXT NOT NULL DEFAULT '',
+    action VARCHAR(20) NOT NULL,
+    before_state TEXT,
+    after_state TEXT,
+    request_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_owner ON audit_log ((COALESCE(owner_id, 0)), id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_todo ON audit_log (todo_id, id);
+
+-- The log is append-only: rows can be added but never changed or removed
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1,9 @@
+-- created_at is stored as UTC text with millisecond precision, see sqliteTimeFormat
+CREATE TABLE IF NOT EXISTS todos (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    text TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    priority VARCHAR(10) DEFAULT 'medium'
+);
+
+CREATE INDEX IF NOT EXISTS idx_todos_created_at ON todos(created_at DESC);
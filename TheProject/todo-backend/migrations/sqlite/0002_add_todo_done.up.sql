@@ -0,0 +1,2 @@
+ALTER TABLE todos ADD COLUMN done BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE todos ADD COLUMN completed_at TIMESTAMP;
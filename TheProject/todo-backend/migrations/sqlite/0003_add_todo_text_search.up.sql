@@ -0,0 +1,3 @@
+-- SQLite searches with instr() instead of a full-text index, so only the
+-- keyset pagination index is needed here
+CREATE INDEX IF NOT EXISTS idx_todos_created_at_id ON todos(created_at DESC, id DESC);
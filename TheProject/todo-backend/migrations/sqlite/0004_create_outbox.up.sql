@@ -0,0 +1,17 @@
+-- Todo changes waiting to be delivered to the outbox webhook. Rows are
+-- written in the same transaction as the change, so none can be lost.
+-- Times are UTC text set by the backend, see sqliteTimeFormat.
+CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_type VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT,
+    sent_at TIMESTAMP
+);
+
+-- The relay only ever looks for undelivered rows that are due
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(next_attempt_at) WHERE sent_at IS NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_todos_owner;
+ALTER TABLE todos DROP COLUMN owner_id;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
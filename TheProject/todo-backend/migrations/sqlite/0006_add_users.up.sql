@@ -0,0 +1,24 @@
+-- Accounts owning todos. Passwords are bcrypt hashes, and sessions keep only
+-- the SHA-256 hash of their token. Times are UTC text set by the backend,
+-- see sqliteTimeFormat.
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(32) NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+
+-- Todos without an owner make up the public board. SQLite cannot drop a
+-- column used by a foreign key, so owner_id does not declare one.
+ALTER TABLE todos ADD COLUMN owner_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_todos_owner ON todos (COALESCE(owner_id, 0), created_at DESC);
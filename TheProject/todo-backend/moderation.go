@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// moderationRule is one step of the moderation pipeline. check returns a
+// message describing the violation, or an empty string when text passes.
+type moderationRule struct {
+	name  string
+	check func(text string) string
+}
+
+// moderationPipeline runs every rule in order and stops at the first failure
+type moderationPipeline []moderationRule
+
+// moderation holds the rules every todo text must pass, see
+// loadModerationFromEnv
+var moderation moderationPipeline
+
+// linkPattern finds the links counted and checked against the domain lists
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+
+// Check returns the name of the first rule text breaks and its message, or
+// empty strings when text passes every rule
+func (p moderationPipeline) Check(text string) (rule, message string) {
+	for _, r := range p {
+		if message := r.check(text); message != "" {
+			return r.name, message
+		}
+	}
+	return "", ""
+}
+
+// loadModerationFromEnv builds the pipeline from:
+//   - MODERATION_BANNED_WORDS_FILE: one word or phrase per line, matched as
+//     whole words ignoring case
+//   - MODERATION_PATTERNS_FILE: one `name=regex` rule per line
+//   - MODERATION_DENIED_DOMAINS: comma separated domains links may not point to
+//   - MODERATION_ALLOWED_DOMAINS: comma separated domains, when set links may
+//     only point to these
+//   - MODERATION_MAX_LINKS: the most links a todo may contain
+//
+// Blank lines and lines starting with # are ignored in both files. Subdomains
+// match their parent domain. Rules that are not configured are skipped.
+func loadModerationFromEnv() (moderationPipeline, error) {
+	var pipeline moderationPipeline
+
+	if path := os.Getenv("MODERATION_BANNED_WORDS_FILE"); path != "" {
+		words, err := readRuleLines(path)
+		if err != nil {
+			return nil, err
+		}
+		if rule, ok := bannedWordsRule(words); ok {
+			pipeline = append(pipeline, rule)
+		}
+	}
+
+	if path := os.Getenv("MODERATION_PATTERNS_FILE"); path != "" {
+		lines, err := readRuleLines(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			rule, err := patternRule(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule in %s: %v", path, err)
+			}
+			pipeline = append(pipeline, rule)
+		}
+	}
+
+	if maxLinks := os.Getenv("MODERATION_MAX_LINKS"); maxLinks != "" {
+		limit, err := strconv.Atoi(maxLinks)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("MODERATION_MAX_LINKS must be a non-negative number, got %q", maxLinks)
+		}
+		pipeline = append(pipeline, maxLinksRule(limit))
+	}
+
+	if denied := splitDomains(os.Getenv("MODERATION_DENIED_DOMAINS")); len(denied) > 0 {
+		pipeline = append(pipeline, moderationRule{
+			name: "denied_domain",
+			check: func(text string) string {
+				for _, host := range linkHosts(text) {
+					if matchesDomain(host, denied) {
+						return fmt.Sprintf("Links to %s are not allowed", host)
+					}
+				}
+				return ""
+			},
+		})
+	}
+
+	if allowed := splitDomains(os.Getenv("MODERATION_ALLOWED_DOMAINS")); len(allowed) > 0 {
+		pipeline = append(pipeline, moderationRule{
+			name: "domain_not_allowed",
+			check: func(text string) string {
+				for _, host := range linkHosts(text) {
+					if !matchesDomain(host, allowed) {
+						return fmt.Sprintf("Links may only point to %s", strings.Join(allowed, ", "))
+					}
+				}
+				return ""
+			},
+		})
+	}
+
+	names := make([]string, 0, len(pipeline))
+	for _, r := range pipeline {
+		names = append(names, r.name)
+	}
+	slog.Info("Moderation rules loaded", "rules", names)
+
+	return pipeline, nil
+}
+
+// bannedWordsRule rejects text containing any of words as a whole word
+func bannedWordsRule(words []string) (moderationRule, bool) {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, regexp.QuoteMeta(strings.ToLower(word)))
+	}
+	if len(quoted) == 0 {
+		return moderationRule{}, false
+	}
+
+	banned := regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	return moderationRule{
+		name: "banned_word",
+		check: func(text string) string {
+			if banned.MatchString(text) {
+				return "Text contains a banned word"
+			}
+			return ""
+		},
+	}, true
+}
+
+// patternRule parses a `name=regex` line into a rule named pattern:name
+func patternRule(line string) (moderationRule, error) {
+	name, expr, ok := strings.Cut(line, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return moderationRule{}, fmt.Errorf("expected name=regex, got %q", line)
+	}
+
+	pattern, err := regexp.Compile(strings.TrimSpace(expr))
+	if err != nil {
+		return moderationRule{}, fmt.Errorf("pattern %s: %v", name, err)
+	}
+
+	return moderationRule{
+		name: "pattern:" + name,
+		check: func(text string) string {
+			if pattern.MatchString(text) {
+				return fmt.Sprintf("Text matches the %s rule", name)
+			}
+			return ""
+		},
+	}, nil
+}
+
+// maxLinksRule rejects text with more than limit links
+func maxLinksRule(limit int) moderationRule {
+	return moderationRule{
+		name: "too_many_links",
+		check: func(text string) string {
+			if links := len(linkPattern.FindAllString(text, -1)); links > limit {
+				return fmt.Sprintf("Text may contain at most %d links, found %d", limit, links)
+			}
+			return ""
+		},
+	}
+}
+
+// linkHosts returns the lower case host name of every link in text
+func linkHosts(text string) []string {
+	var hosts []string
+	for _, link := range linkPattern.FindAllString(text, -1) {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		parsed, err := url.Parse(link)
+		if err != nil || parsed.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, strings.ToLower(parsed.Hostname()))
+	}
+	return hosts
+}
+
+// matchesDomain reports whether host is one of domains or a subdomain of one
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitDomains parses a comma separated domain list
+func splitDomains(list string) []string {
+	var domains []string
+	for _, domain := range strings.Split(list, ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// readRuleLines reads the non-empty, non-comment lines of a rule file
+func readRuleLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open moderation rules: %v", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read moderation rules %s: %v", path, err)
+	}
+	return lines, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeRuleFile writes lines to a rule file in a temporary directory
+func writeRuleFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setModerationEnv sets every MODERATION_ variable, leaving out the ones not
+// in env
+func setModerationEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, key := range []string{"MODERATION_BANNED_WORDS_FILE", "MODERATION_PATTERNS_FILE",
+		"MODERATION_DENIED_DOMAINS", "MODERATION_ALLOWED_DOMAINS", "MODERATION_MAX_LINKS"} {
+		t.Setenv(key, env[key])
+	}
+}
+
+func TestModerationRules(t *testing.T) {
+	setModerationEnv(t, map[string]string{
+		"MODERATION_BANNED_WORDS_FILE": writeRuleFile(t, "# one per line", "", "spam", "Buy Now"),
+		"MODERATION_PATTERNS_FILE":     writeRuleFile(t, "phone=\\b\\d{3}-\\d{4}\\b", "shouting = ^[A-Z !]{10,}$"),
+		"MODERATION_DENIED_DOMAINS":    "evil.example, Tracker.example",
+		"MODERATION_ALLOWED_DOMAINS":   "example.com,evil.example,tracker.example",
+		"MODERATION_MAX_LINKS":         "2",
+	})
+	pipeline, err := loadModerationFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		rule string
+	}{
+		{"Buy milk", ""},
+		{"No SPAM please", "banned_word"},
+		{"buy now and save", "banned_word"},
+		// Banned words only match whole words
+		{"Read about spammers", ""},
+		{"Call 555-1234", "pattern:phone"},
+		{"WAKE UP NOW !!", "pattern:shouting"},
+		{"Wake up now !!", ""},
+		{"See https://example.com/a and www.example.com/b", ""},
+		{"See https://a.example.com https://b.example.com http://c.example.com", "too_many_links"},
+		{"Open https://evil.example/x", "denied_domain"},
+		{"Open https://cdn.tracker.example/pixel", "denied_domain"},
+		{"Open https://other.org", "domain_not_allowed"},
+		{"Open www.other.org/page", "domain_not_allowed"},
+		{"Open https://docs.example.com/guide", ""},
+		// A domain that only ends in an allowed one is not a subdomain
+		{"Open https://notexample.com", "domain_not_allowed"},
+	}
+	for _, tt := range tests {
+		rule, message := pipeline.Check(tt.text)
+		if rule != tt.rule {
+			t.Errorf("Check(%q) = %q, want %q", tt.text, rule, tt.rule)
+		}
+		if (message != "") != (tt.rule != "") {
+			t.Errorf("Check(%q) message = %q", tt.text, message)
+		}
+	}
+}
+
+func TestModerationWithoutRules(t *testing.T) {
+	setModerationEnv(t, nil)
+	pipeline, err := loadModerationFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pipeline) != 0 {
+		t.Fatalf("pipeline has %d rules, want none", len(pipeline))
+	}
+	if rule, _ := pipeline.Check("https://a.example https://b.example spam"); rule != "" {
+		t.Fatalf("empty pipeline rejected text with %s", rule)
+	}
+
+	// A banned words file with nothing but comments adds no rule
+	setModerationEnv(t, map[string]string{"MODERATION_BANNED_WORDS_FILE": writeRuleFile(t, "# nothing yet")})
+	if pipeline, err := loadModerationFromEnv(); err != nil || len(pipeline) != 0 {
+		t.Fatalf("pipeline = %d rules, %v; want none", len(pipeline), err)
+	}
+}
+
+func TestModerationConfigErrors(t *testing.T) {
+	tests := map[string]map[string]string{
+		"missing banned words file": {"MODERATION_BANNED_WORDS_FILE": filepath.Join(t.TempDir(), "missing.txt")},
+		"missing patterns file":     {"MODERATION_PATTERNS_FILE": filepath.Join(t.TempDir(), "missing.txt")},
+		"pattern without name":      {"MODERATION_PATTERNS_FILE": writeRuleFile(t, "=spam")},
+		"pattern without regex":     {"MODERATION_PATTERNS_FILE": writeRuleFile(t, "just a line")},
+		"invalid regex":             {"MODERATION_PATTERNS_FILE": writeRuleFile(t, "broken=(unclosed")},
+		"max links not a number":    {"MODERATION_MAX_LINKS": "few"},
+		"negative max links":        {"MODERATION_MAX_LINKS": "-1"},
+	}
+	for name, env := range tests {
+		t.Run(name, func(t *testing.T) {
+			setModerationEnv(t, env)
+			if _, err := loadModerationFromEnv(); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestCreateTodoModerated(t *testing.T) {
+	api := newTestAPI(t)
+	setModerationEnv(t, map[string]string{"MODERATION_BANNED_WORDS_FILE": writeRuleFile(t, "spam")})
+	var err error
+	if moderation, err = loadModerationFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	problem := expectProblem(t, api.do("POST", "/todos", `{"text":"Send spam"}`),
+		http.StatusUnprocessableEntity, codeModerationFailed)
+	if problem.Rule != "banned_word" || problem.Field != "/text" || problem.Detail == "" {
+		t.Fatalf("problem = %+v", problem)
+	}
+
+	var todos []Todo
+	decodeBody(t, api.do("GET", "/todos", ""), &todos)
+	if len(todos) != 0 {
+		t.Fatalf("rejected todo was stored: %+v", todos)
+	}
+
+	if rec := api.do("POST", "/todos", `{"text":"Send mail"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// maxRequestBodySize bounds the JSON bodies read by decodeRequest
+const maxRequestBodySize = 64 << 10
+
+// openAPIDocument describes the API, served at GET /openapi.json. Request
+// bodies are validated against its component schemas.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// jsonSchema is the part of an OpenAPI schema that request bodies are
+// checked against: types, required and unknown fields, and enums. Limits on
+// the length and format of strings are left to the handlers, whose messages
+// and rejection reasons are more specific.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	MinProperties        int                    `json:"minProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+}
+
+// schemas are the component schemas of openAPIDocument by name
+var schemas = mustLoadSchemas(openAPIDocument)
+
+func mustLoadSchemas(document []byte) map[string]*jsonSchema {
+	var spec struct {
+		Components struct {
+			Schemas map[string]*jsonSchema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(document, &spec); err != nil {
+		panic(fmt.Sprintf("invalid openapi.json: %v", err))
+	}
+	return spec.Components.Schemas
+}
+
+// fieldError is one thing wrong with a request body. Field is a JSON
+// pointer to the offending value, empty for the body as a whole.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validate checks value, decoded with UseNumber, against schema
+func (s *jsonSchema) validate(value interface{}, pointer string) []fieldError {
+	if s.Ref != "" {
+		ref, ok := schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+		if !ok {
+			panic("unknown schema " + s.Ref)
+		}
+		return ref.validate(value, pointer)
+	}
+
+	if !s.hasType(value) {
+		return []fieldError{{Field: pointer, Message: "must be " + article(s.Type) + " " + s.Type}}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if value == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return []fieldError{{Field: pointer, Message: fmt.Sprintf("must be one of %v", s.Enum)}}
+		}
+	}
+
+	var errs []fieldError
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if len(value) < s.MinProperties {
+			errs = append(errs, fieldError{Field: pointer,
+				Message: fmt.Sprintf("must have at least %d field(s)", s.MinProperties)})
+		}
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				errs = append(errs, fieldError{Field: pointer + "/" + name, Message: "is required"})
+			}
+		}
+
+		// Sorted, so the errors come in a stable order
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					errs = append(errs, fieldError{Field: pointer + "/" + name, Message: "is not a known field"})
+				}
+				continue
+			}
+			errs = append(errs, property.validate(value[name], pointer+"/"+name)...)
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range value {
+				errs = append(errs, s.Items.validate(item, fmt.Sprintf("%s/%d", pointer, i))...)
+			}
+		}
+	}
+	return errs
+}
+
+// hasType reports whether value is of the schema's type. null is never
+// accepted, as no field is nullable.
+func (s *jsonSchema) hasType(value interface{}) bool {
+	switch s.Type {
+	case "":
+		return true
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := number.Int64()
+		return err == nil
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	default:
+		return false
+	}
+}
+
+func article(word string) string {
+	if strings.IndexByte("aeiou", word[0]) >= 0 {
+		return "an"
+	}
+	return "a"
+}
+
+// decodeRequest reads the JSON body of r, validates it against the named
+// schema of openAPIDocument and decodes it into dst. When the body is not
+// valid it writes a 400 problem and returns the reason for log lines and
+// metrics: invalid_json or invalid_request.
+func decodeRequest(w http.ResponseWriter, r *http.Request, schema string, dst interface{}) (reason string) {
+	logger := loggerFromContext(r.Context())
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_json", "error", err)
+		writeProblem(w, r, &apiError{Code: codeInvalidJSON, Detail: "The request body could not be read"})
+		return "invalid_json"
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&value)
+	if err == nil && decoder.Decode(new(interface{})) != io.EOF {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_json", "error", err)
+		writeProblem(w, r, &apiError{Code: codeInvalidJSON, Detail: "Invalid JSON"})
+		return "invalid_json"
+	}
+
+	if errs := schemas[schema].validate(value, ""); len(errs) > 0 {
+		logger.Warn("REJECT", "reason", "invalid_request", "schema", schema, "errors", errs)
+		writeProblem(w, r, &apiError{Code: codeInvalidRequest,
+			Detail: "The request body does not match the " + schema + " schema", Errors: errs})
+		return "invalid_request"
+	}
+
+	// The schema matched, so this cannot fail on types
+	if err := json.Unmarshal(data, dst); err != nil {
+		logger.Warn("REJECT", "reason", "invalid_json", "error", err)
+		writeProblem(w, r, &apiError{Code: codeInvalidJSON, Detail: "Invalid JSON"})
+		return "invalid_json"
+	}
+	return ""
+}
+
+// GET /openapi.json - The OpenAPI 3 document of this API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// decodeValue decodes a JSON value the way decodeRequest does
+func decodeValue(t *testing.T, data string) interface{} {
+	t.Helper()
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	return value
+}
+
+func TestValidate(t *testing.T) {
+	// A schema of its own, for what the request schemas do not use
+	var tagged jsonSchema
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"size": {"type": "string", "enum": ["small", "large"]},
+			"count": {"type": "integer"},
+			"ratio": {"type": "number"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"user": {"$ref": "#/components/schemas/User"}
+		}
+	}`), &tagged); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		schema *jsonSchema
+		body   string
+		want   []fieldError
+	}{
+		{"valid create", schemas["CreateTodoRequest"], `{"text":"Buy milk","priority":"high"}`, nil},
+		{"missing required field", schemas["CreateTodoRequest"], `{"priority":"high"}`,
+			[]fieldError{{"/text", "is required"}}},
+		{"every missing field", schemas["CredentialsRequest"], `{}`,
+			[]fieldError{{"/username", "is required"}, {"/password", "is required"}}},
+		{"wrong type", schemas["CreateTodoRequest"], `{"text":42}`,
+			[]fieldError{{"/text", "must be a string"}}},
+		{"null is not a string", schemas["CreateTodoRequest"], `{"text":null}`,
+			[]fieldError{{"/text", "must be a string"}}},
+		{"body not an object", schemas["CreateTodoRequest"], `["Buy milk"]`,
+			[]fieldError{{"", "must be an object"}}},
+		{"unknown fields, sorted", schemas["CreateTodoRequest"], `{"text":"a","due":"today","color":"red"}`,
+			[]fieldError{{"/color", "is not a known field"}, {"/due", "is not a known field"}}},
+		{"too few fields", schemas["UpdateTodoRequest"], `{}`,
+			[]fieldError{{"", "must have at least 1 field(s)"}}},
+		{"allowed enum value", &tagged, `{"size":"large"}`, nil},
+		{"enum", &tagged, `{"size":"medium"}`,
+			[]fieldError{{"/size", "must be one of [small large]"}}},
+		{"integer", &tagged, `{"count":1.5}`,
+			[]fieldError{{"/count", "must be an integer"}}},
+		{"number", &tagged, `{"count":2,"ratio":"half"}`,
+			[]fieldError{{"/ratio", "must be a number"}}},
+		{"array items", &tagged, `{"tags":["a",2,"c",false]}`,
+			[]fieldError{{"/tags/1", "must be a string"}, {"/tags/3", "must be a string"}}},
+		// Without additionalProperties: false other fields are fine
+		{"reference", &tagged, `{"user":{"id":"one","username":"alice","extra":true}}`,
+			[]fieldError{{"/user/created_at", "is required"}, {"/user/id", "must be an integer"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.schema.validate(decodeValue(t, tt.body), "")
+			if len(got) != len(tt.want) {
+				t.Fatalf("errors = %+v, want %+v", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("errors = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidRequestProblem(t *testing.T) {
+	api := newTestAPI(t)
+
+	problem := expectProblem(t, api.do("POST", "/todos", `{"text":7,"due":"today"}`),
+		http.StatusBadRequest, codeInvalidRequest)
+	want := []fieldError{{"/due", "is not a known field"}, {"/text", "must be a string"}}
+	if len(problem.Errors) != len(want) || problem.Errors[0] != want[0] || problem.Errors[1] != want[1] {
+		t.Fatalf("errors = %+v, want %+v", problem.Errors, want)
+	}
+	if !strings.Contains(problem.Detail, "CreateTodoRequest") {
+		t.Fatalf("detail = %q", problem.Detail)
+	}
+
+	// Broken JSON is not checked against the schema at all
+	problem = expectProblem(t, api.do("POST", "/todos", `{"text":`), http.StatusBadRequest, codeInvalidJSON)
+	if len(problem.Errors) != 0 {
+		t.Fatalf("errors = %+v", problem.Errors)
+	}
+	expectProblem(t, api.do("POST", "/todos", `{"text":"a"} {"text":"b"}`), http.StatusBadRequest, codeInvalidJSON)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// outboxBatchSize is how many entries the relay claims at a time
+	outboxBatchSize = 20
+	// outboxLease hides claimed entries from other replicas while they are
+	// delivered. It must outlast a batch of webhook calls.
+	outboxLease = 5 * time.Minute
+	// outboxWebhookTimeout bounds a single webhook call
+	outboxWebhookTimeout = 10 * time.Second
+	// outboxPurgeInterval is how often delivered entries are cleaned up
+	outboxPurgeInterval = time.Hour
+)
+
+// outboxEntry is a todo change recorded in the outbox, waiting to be
+// delivered to the webhook
+type outboxEntry struct {
+	ID        int64
+	EventType string
+	// Payload is the todo's JSON at the time of the change
+	Payload   []byte
+	RequestID string
+	CreatedAt time.Time
+	// Attempts counts delivery attempts, including the one in progress
+	Attempts int
+}
+
+// outboxStore is implemented by stores that record every todo change in an
+// outbox in the same transaction as the change itself
+type outboxStore interface {
+	// ClaimOutbox returns up to limit undelivered entries that are due, oldest
+	// first, and keeps them from being claimed again until lease has passed
+	ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]outboxEntry, error)
+	MarkOutboxSent(ctx context.Context, id int64) error
+	// RetryOutboxLater records a failed delivery and when to try again
+	RetryOutboxLater(ctx context.Context, id int64, at time.Time, deliveryErr string) error
+	// PurgeOutbox deletes entries delivered before the given time
+	PurgeOutbox(ctx context.Context, before time.Time) (int64, error)
+}
+
+// newOutboxEntry records a change to todo made while serving ctx
+func newOutboxEntry(ctx context.Context, eventType string, todo Todo) (outboxEntry, error) {
+	payload, err := json.Marshal(todo)
+	if err != nil {
+		return outboxEntry{}, err
+	}
+	return outboxEntry{
+		EventType: eventType,
+		Payload:   payload,
+		RequestID: requestIDFromContext(ctx),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// outboxEnabled reports whether stores should record changes in the outbox.
+// Without a webhook nothing would ever deliver them.
+func outboxEnabled() bool {
+	return os.Getenv("OUTBOX_WEBHOOK_URL") != ""
+}
+
+// outboxPublicBoardOnly reports whether OUTBOX_PUBLIC_BOARD_ONLY keeps the
+// changes to users' private lists out of the outbox, for webhooks that must
+// not see them
+func outboxPublicBoardOnly() bool {
+	return os.Getenv("OUTBOX_PUBLIC_BOARD_ONLY") == "true"
+}
+
+// outboxDelivery is the JSON body POSTed to the webhook for every entry
+type outboxDelivery struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	RequestID string          `json:"request_id,omitempty"`
+	Todo      json.RawMessage `json:"todo"`
+}
+
+// outboxRelay delivers outbox entries to a webhook. Every entry is retried
+// with exponential backoff until the webhook accepts it, so delivery is at
+// least once; receivers can use the X-Outbox-Event-ID header to drop
+// duplicates.
+type outboxRelay struct {
+	store        outboxStore
+	webhookURL   string
+	client       *http.Client
+	pollInterval time.Duration
+	maxBackoff   time.Duration
+	retention    time.Duration
+}
+
+// newOutboxRelayFromEnv configures the relay from OUTBOX_WEBHOOK_URL,
+// OUTBOX_POLL_INTERVAL, OUTBOX_MAX_BACKOFF and OUTBOX_RETENTION
+func newOutboxRelayFromEnv(store outboxStore) (*outboxRelay, error) {
+	pollInterval, err := intervalFromEnv("OUTBOX_POLL_INTERVAL", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &outboxRelay{
+		store:        store,
+		webhookURL:   os.Getenv("OUTBOX_WEBHOOK_URL"),
+		client:       &http.Client{Timeout: outboxWebhookTimeout},
+		pollInterval: pollInterval,
+		maxBackoff:   durationFromEnv("OUTBOX_MAX_BACKOFF", 5*time.Minute),
+		retention:    durationFromEnv("OUTBOX_RETENTION", 7*24*time.Hour),
+	}, nil
+}
+
+// Run delivers due entries every poll interval until ctx is cancelled
+func (r *outboxRelay) Run(ctx context.Context) {
+	slog.Info("Outbox relay started", "poll_interval", r.pollInterval.String(),
+		"max_backoff", r.maxBackoff.String(), "retention", r.retention.String())
+
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+	for {
+		// Keep going while full batches come back, to work off a backlog
+		for ctx.Err() == nil {
+			if r.relayBatch(ctx) < outboxBatchSize {
+				break
+			}
+		}
+
+		if time.Since(lastPurge) >= outboxPurgeInterval {
+			r.purge(ctx)
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Outbox relay stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayBatch claims and delivers one batch, returning its size
+func (r *outboxRelay) relayBatch(ctx context.Context) int {
+	entries, err := r.store.ClaimOutbox(ctx, outboxBatchSize, outboxLease)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("ERROR", "event", "outbox_claim_failed", "error", err)
+		}
+		return 0
+	}
+
+	for i, entry := range entries {
+		// Entries left over at shutdown are retried once their lease expires
+		if ctx.Err() != nil {
+			return i
+		}
+		r.deliver(entry)
+	}
+	return len(entries)
+}
+
+// deliver sends one entry to the webhook and records the outcome. The
+// outcome is recorded even during shutdown, so it uses its own context.
+func (r *outboxRelay) deliver(entry outboxEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), outboxWebhookTimeout+5*time.Second)
+	defer cancel()
+
+	logger := slog.With("outbox_id", entry.ID, "type", entry.EventType, "request_id", entry.RequestID)
+
+	if err := r.post(ctx, entry); err != nil {
+		retryIn := r.backoff(entry.Attempts)
+		outboxDeliveriesTotal.WithLabelValues("failed").Inc()
+		logger.Warn("OUTBOX", "event", "delivery_failed", "attempts", entry.Attempts,
+			"retry_in", retryIn.String(), "error", err)
+
+		if err := r.store.RetryOutboxLater(ctx, entry.ID, time.Now().UTC().Add(retryIn), err.Error()); err != nil {
+			logger.Error("ERROR", "event", "outbox_update_failed", "error", err)
+		}
+		return
+	}
+
+	outboxDeliveriesTotal.WithLabelValues("sent").Inc()
+	if err := r.store.MarkOutboxSent(ctx, entry.ID); err != nil {
+		// The entry is delivered again once its lease expires
+		logger.Error("ERROR", "event", "outbox_update_failed", "error", err)
+		return
+	}
+	logger.Info("OUTBOX", "event", "delivered", "attempts", entry.Attempts)
+}
+
+// post sends entry to the webhook, succeeding on any 2xx response
+func (r *outboxRelay) post(ctx context.Context, entry outboxEntry) error {
+	body, err := json.Marshal(outboxDelivery{
+		ID:        entry.ID,
+		Type:      entry.EventType,
+		CreatedAt: entry.CreatedAt,
+		RequestID: entry.RequestID,
+		Todo:      entry.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Outbox-Event-ID", strconv.FormatInt(entry.ID, 10))
+	if entry.RequestID != "" {
+		req.Header.Set(requestIDHeader, entry.RequestID)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff doubles the wait after every failed attempt, starting at one
+// second and capped at maxBackoff
+func (r *outboxRelay) backoff(attempts int) time.Duration {
+	wait := time.Second
+	for i := 1; i < attempts && wait < r.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > r.maxBackoff {
+		wait = r.maxBackoff
+	}
+	return wait
+}
+
+// purge deletes entries delivered longer ago than the retention period
+func (r *outboxRelay) purge(ctx context.Context) {
+	purged, err := r.store.PurgeOutbox(ctx, time.Now().UTC().Add(-r.retention))
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("ERROR", "event", "outbox_purge_failed", "error", err)
+		}
+		return
+	}
+	if purged > 0 {
+		slog.Info("OUTBOX", "event", "purged", "count", purged)
+	}
+}
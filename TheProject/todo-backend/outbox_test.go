@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOutboxRelayPollInterval(t *testing.T) {
+	t.Setenv("OUTBOX_POLL_INTERVAL", "")
+	relay, err := newOutboxRelayFromEnv(newMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay.pollInterval != 2*time.Second {
+		t.Fatalf("default poll interval = %s, want 2s", relay.pollInterval)
+	}
+
+	// A zero interval would panic in time.NewTicker once the relay runs
+	for _, value := range []string{"0", "-5s", "often"} {
+		t.Setenv("OUTBOX_POLL_INTERVAL", value)
+		if _, err := newOutboxRelayFromEnv(newMemoryStore()); err == nil {
+			t.Fatalf("OUTBOX_POLL_INTERVAL=%s accepted", value)
+		}
+	}
+}
+
+// outboxTypes returns the event types in the outbox of s, oldest first
+func outboxTypes(s *memoryStore) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var types []string
+	for _, entry := range s.outboxEntries {
+		types = append(types, entry.EventType)
+	}
+	return types
+}
+
+func TestOutboxRecordsChanges(t *testing.T) {
+	api := newTestAPI(t)
+	api.store.outbox = true
+
+	todo := api.createTodo("Deliver me")
+	path := "/todos/" + strconv.Itoa(todo.ID)
+	api.do("PATCH", path, `{"text":"Delivered"}`)
+	api.do("DELETE", path, "")
+
+	want := []string{eventTodoCreated, eventTodoUpdated, eventTodoDeleted}
+	if got := outboxTypes(api.store); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("outbox = %v, want %v", got, want)
+	}
+}
+
+func TestOutboxRelayDelivers(t *testing.T) {
+	api := newTestAPI(t)
+	api.store.outbox = true
+	todo := api.createTodo("Deliver me", requestIDHeader, "req-create")
+
+	// The webhook fails once, then accepts
+	var calls atomic.Int32
+	var delivery outboxDelivery
+	var eventID string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		eventID = r.Header.Get("X-Outbox-Event-ID")
+		json.NewDecoder(r.Body).Decode(&delivery)
+	}))
+	t.Cleanup(webhook.Close)
+
+	relay := &outboxRelay{store: api.store, webhookURL: webhook.URL, client: webhook.Client(),
+		pollInterval: time.Second, maxBackoff: time.Minute, retention: time.Hour}
+	ctx := context.Background()
+
+	if n := relay.relayBatch(ctx); n != 1 {
+		t.Fatalf("first batch delivered %d entries, want 1", n)
+	}
+	api.store.mu.Lock()
+	entry := api.store.outboxEntries[0]
+	api.store.mu.Unlock()
+	if entry.sentAt != nil || entry.lastError == "" || !entry.nextAttemptAt.After(time.Now()) {
+		t.Fatalf("failed delivery recorded as %+v", entry)
+	}
+
+	// Make the retry due instead of waiting for the backoff
+	api.store.mu.Lock()
+	api.store.outboxEntries[0].nextAttemptAt = time.Now()
+	api.store.mu.Unlock()
+	relay.relayBatch(ctx)
+
+	var delivered Todo
+	json.Unmarshal(delivery.Todo, &delivered)
+	if calls.Load() != 2 || eventID != "1" || delivery.Type != eventTodoCreated ||
+		delivery.RequestID != "req-create" || delivered.ID != todo.ID {
+		t.Fatalf("delivery %+v (event ID %q) after %d calls", delivery, eventID, calls.Load())
+	}
+	api.store.mu.Lock()
+	sent := api.store.outboxEntries[0].sentAt
+	api.store.mu.Unlock()
+	if sent == nil {
+		t.Fatal("delivered entry not marked as sent")
+	}
+
+	// Nothing is left to deliver
+	if n := relay.relayBatch(ctx); n != 0 || calls.Load() != 2 {
+		t.Fatalf("second batch claimed %d entries", n)
+	}
+}
+
+func TestOutboxRecordsPrivateLists(t *testing.T) {
+	api := newTestAPI(t)
+	api.store.outbox = true
+	alice := api.signup("alice")
+
+	api.createTodo("Private", "Authorization", alice)
+	if got := outboxTypes(api.store); len(got) != 1 || got[0] != eventTodoCreated {
+		t.Fatalf("outbox = %v, want the private todo's creation", got)
+	}
+
+	// OUTBOX_PUBLIC_BOARD_ONLY leaves users' lists out
+	api.store.outboxPublicOnly = true
+	api.createTodo("Also private", "Authorization", alice)
+	api.createTodo("Public")
+	if got := outboxTypes(api.store); len(got) != 2 {
+		t.Fatalf("outbox = %v, want the private and the public creation only", got)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// listOptions holds the filters, ordering and page position of a GET /todos
+type listOptions struct {
+	// Owner is whose list to page through, see TodoStore
+	Owner  int
+	Done   *bool
+	Query  string
+	Sort   string // "created" or "priority"
+	Order  string // "desc" or "asc"
+	Limit  int
+	Cursor *todoCursor
+}
+
+// todoCursor marks the last todo of a page. The next page starts right after
+// it in the requested sort order. Rank is only used when sorting by priority.
+type todoCursor struct {
+	Rank      int       `json:"r,omitempty"`
+	CreatedAt time.Time `json:"c"`
+	ID        int       `json:"i"`
+}
+
+// parseListOptions reads ?done=&q=&sort=&order=&limit=&cursor= from the request
+func parseListOptions(r *http.Request) (listOptions, error) {
+	query := r.URL.Query()
+	opts := listOptions{
+		Query: query.Get("q"),
+		Sort:  query.Get("sort"),
+		Order: query.Get("order"),
+		Limit: defaultPageSize,
+	}
+
+	if doneParam := query.Get("done"); doneParam != "" {
+		done, err := strconv.ParseBool(doneParam)
+		if err != nil {
+			return opts, fmt.Errorf("done must be true or false")
+		}
+		opts.Done = &done
+	}
+
+	switch opts.Sort {
+	case "":
+		opts.Sort = "created"
+	case "created", "priority":
+	default:
+		return opts, fmt.Errorf("sort must be created or priority")
+	}
+
+	switch opts.Order {
+	case "":
+		opts.Order = "desc"
+	case "asc", "desc":
+	default:
+		return opts, fmt.Errorf("order must be asc or desc")
+	}
+
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		opts.Limit = limit
+	}
+
+	if cursorParam := query.Get("cursor"); cursorParam != "" {
+		cursor, err := decodeCursor(cursorParam)
+		if err != nil {
+			return opts, fmt.Errorf("invalid cursor")
+		}
+		opts.Cursor = &cursor
+	}
+
+	return opts, nil
+}
+
+// cursorAfter builds the cursor pointing at todo for the given sort
+func cursorAfter(todo Todo, opts listOptions) todoCursor {
+	cursor := todoCursor{CreatedAt: todo.CreatedAt, ID: todo.ID}
+	if opts.Sort == "priority" {
+		cursor.Rank = priorityRank(todo.Priority)
+	}
+	return cursor
+}
+
+// encodeCursor turns a cursor into the opaque token handed to clients
+func encodeCursor(cursor todoCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (todoCursor, error) {
+	var cursor todoCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
+
+// listETag is the weak ETag of a GET /todos response: the same query
+// against the same state of an owner's list returns the same todos. Weak,
+// because the relative created text can still differ.
+func listETag(owner int, state storeState, query url.Values) string {
+	// Encode sorts the parameters, so their order does not matter. The
+	// access token is left out, since logging in again does not change the
+	// list.
+	query = maps.Clone(query)
+	query.Del("access_token")
+	hash := fnv.New64a()
+	hash.Write([]byte(query.Encode()))
+	return fmt.Sprintf(`W/"%d-%d-%d-%x"`, owner, state.Count, state.Version, hash.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. Weak and
+// strong forms compare equal, as RFC 9110 asks for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// setPaginationHeaders advertises the next page through X-Next-Cursor and an
+// RFC 8288 Link header that repeats the current query with the new cursor
+func setPaginationHeaders(w http.ResponseWriter, r *http.Request, next string) {
+	query := r.URL.Query()
+	query.Set("cursor", next)
+	nextURL := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+
+	w.Header().Set("X-Next-Cursor", next)
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextURL.String()))
+}
+
+// priorityRank orders priorities so that high sorts above medium above low
+func priorityRank(priority string) int {
+	switch priority {
+	case "high":
+		return 3
+	case "medium":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// priorityRankSQL is the SQL equivalent of priorityRank
+const priorityRankSQL = "CASE priority WHEN 'high' THEN 3 WHEN 'medium' THEN 2 ELSE 1 END"
+
+// compareCursors orders two list positions by rank, then creation time, then
+// ID, returning -1, 0 or 1 like strings.Compare
+func compareCursors(a, b todoCursor) int {
+	switch {
+	case a.Rank != b.Rank:
+		if a.Rank < b.Rank {
+			return -1
+		}
+		return 1
+	case !a.CreatedAt.Equal(b.CreatedAt):
+		if a.CreatedAt.Before(b.CreatedAt) {
+			return -1
+		}
+		return 1
+	case a.ID != b.ID:
+		if a.ID < b.ID {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseListOptions(t *testing.T) {
+	cursor := todoCursor{Rank: 2, CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), ID: 7}
+	token := encodeCursor(cursor)
+
+	tests := []struct {
+		query   string
+		want    listOptions
+		wantErr bool
+	}{
+		{"", listOptions{Sort: "created", Order: "desc", Limit: defaultPageSize}, false},
+		{"?sort=priority&order=asc&limit=10&q=milk", listOptions{Query: "milk", Sort: "priority", Order: "asc", Limit: 10}, false},
+		{"?done=true", listOptions{Sort: "created", Order: "desc", Limit: defaultPageSize}, false},
+		{"?limit=200", listOptions{Sort: "created", Order: "desc", Limit: maxPageSize}, false},
+		{"?cursor=" + token, listOptions{Sort: "created", Order: "desc", Limit: defaultPageSize, Cursor: &cursor}, false},
+		{"?done=maybe", listOptions{}, true},
+		{"?sort=text", listOptions{}, true},
+		{"?order=up", listOptions{}, true},
+		{"?limit=0", listOptions{}, true},
+		{"?limit=201", listOptions{}, true},
+		{"?limit=ten", listOptions{}, true},
+		{"?cursor=not-a-cursor", listOptions{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			opts, err := parseListOptions(httptest.NewRequest("GET", "/todos"+tt.query, nil))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %+v", opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Query != tt.want.Query || opts.Sort != tt.want.Sort || opts.Order != tt.want.Order ||
+				opts.Limit != tt.want.Limit {
+				t.Fatalf("options = %+v, want %+v", opts, tt.want)
+			}
+			if (opts.Cursor == nil) != (tt.want.Cursor == nil) ||
+				(opts.Cursor != nil && compareCursors(*opts.Cursor, *tt.want.Cursor) != 0) {
+				t.Fatalf("cursor = %+v, want %+v", opts.Cursor, tt.want.Cursor)
+			}
+		})
+	}
+
+	opts, _ := parseListOptions(httptest.NewRequest("GET", "/todos?done=false", nil))
+	if opts.Done == nil || *opts.Done {
+		t.Fatalf("done=false parsed as %v", opts.Done)
+	}
+}
+
+func TestCursorAfter(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	todo := Todo{ID: 3, Priority: "high", CreatedAt: created}
+
+	// The rank only takes part when sorting by priority
+	if cursor := cursorAfter(todo, listOptions{Sort: "created"}); cursor.Rank != 0 || cursor.ID != 3 || !cursor.CreatedAt.Equal(created) {
+		t.Fatalf("sort=created cursor = %+v", cursor)
+	}
+	cursor := cursorAfter(todo, listOptions{Sort: "priority"})
+	if cursor.Rank != 3 || cursor.ID != 3 || !cursor.CreatedAt.Equal(created) {
+		t.Fatalf("sort=priority cursor = %+v", cursor)
+	}
+
+	decoded, err := decodeCursor(encodeCursor(cursor))
+	if err != nil || compareCursors(decoded, cursor) != 0 {
+		t.Fatalf("decoded cursor = %+v, %v; want %+v", decoded, err, cursor)
+	}
+}
+
+func TestCompareCursors(t *testing.T) {
+	earlier := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Second)
+
+	tests := []struct {
+		name string
+		a, b todoCursor
+		want int
+	}{
+		{"same", todoCursor{Rank: 2, CreatedAt: earlier, ID: 1}, todoCursor{Rank: 2, CreatedAt: earlier, ID: 1}, 0},
+		{"rank first", todoCursor{Rank: 1, CreatedAt: later, ID: 9}, todoCursor{Rank: 3, CreatedAt: earlier, ID: 1}, -1},
+		{"then creation time", todoCursor{CreatedAt: later, ID: 1}, todoCursor{CreatedAt: earlier, ID: 9}, 1},
+		{"then ID", todoCursor{CreatedAt: earlier, ID: 2}, todoCursor{CreatedAt: earlier, ID: 5}, -1},
+		// Times in other zones compare by instant
+		{"same instant", todoCursor{CreatedAt: earlier.In(time.FixedZone("CEST", 2*3600)), ID: 1}, todoCursor{CreatedAt: earlier, ID: 1}, 0},
+	}
+	for _, tt := range tests {
+		if got := compareCursors(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: compareCursors = %d, want %d", tt.name, got, tt.want)
+		}
+		if got := compareCursors(tt.b, tt.a); got != -tt.want {
+			t.Errorf("%s: reversed compareCursors = %d, want %d", tt.name, got, -tt.want)
+		}
+	}
+}
+
+func TestListETag(t *testing.T) {
+	api := newTestAPI(t)
+	todo := api.createTodo("Cache me")
+
+	// revalidate expects GET /todos with the given ETag to answer status, and
+	// returns the current ETag
+	revalidate := func(etag string, status int) string {
+		t.Helper()
+		rec := api.do("GET", "/todos", "", "If-None-Match", etag)
+		if rec.Code != status {
+			t.Fatalf("If-None-Match %s: status %d, want %d", etag, rec.Code, status)
+		}
+		if status == http.StatusNotModified && rec.Body.Len() > 0 {
+			t.Fatalf("304 with a body: %s", rec.Body)
+		}
+		return rec.Header().Get("ETag")
+	}
+
+	etag := api.do("GET", "/todos", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /todos sent no ETag")
+	}
+	revalidate(etag, http.StatusNotModified)
+
+	// Another query of the same list has its own ETag
+	if other := api.do("GET", "/todos?sort=priority", "").Header().Get("ETag"); other == etag {
+		t.Fatal("sort=priority has the ETag of the default query")
+	}
+
+	path := "/todos/" + strconv.Itoa(todo.ID)
+	changes := []struct {
+		name         string
+		method, path string
+		body         string
+	}{
+		{"create", "POST", "/todos", `{"text":"Another"}`},
+		{"update", "PATCH", path, `{"text":"Changed"}`},
+		{"done", "PUT", path + "/done", ""},
+		{"delete", "DELETE", path, ""},
+	}
+	for _, change := range changes {
+		if rec := api.do(change.method, change.path, change.body); rec.Code >= 300 {
+			t.Fatalf("%s: status %d: %s", change.name, rec.Code, rec.Body)
+		}
+		next := revalidate(etag, http.StatusOK)
+		if next == etag {
+			t.Fatalf("%s kept the ETag %s", change.name, etag)
+		}
+		etag = next
+		revalidate(etag, http.StatusNotModified)
+	}
+}
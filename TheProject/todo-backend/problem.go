@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// errorCode names a failure in a way clients can act on, unlike Detail which
+// is meant for people and may change. Codes are never renamed once shipped.
+type errorCode string
+
+// Error codes, mostly the upper case of the reason logged with REJECT
+const (
+	codeInvalidJSON         errorCode = "INVALID_JSON"
+	codeInvalidRequest      errorCode = "INVALID_REQUEST"
+	codeEmptyText           errorCode = "EMPTY_TEXT"
+	codeTextTooLong         errorCode = "TEXT_TOO_LONG"
+	codeModerationFailed    errorCode = "MODERATION_FAILED"
+	codeInvalidID           errorCode = "INVALID_ID"
+	codeInvalidListOptions  errorCode = "INVALID_LIST_OPTIONS"
+	codeInvalidAuditOptions errorCode = "INVALID_AUDIT_OPTIONS"
+	codeTodoNotFound        errorCode = "TODO_NOT_FOUND"
+	codeMethodNotAllowed    errorCode = "METHOD_NOT_ALLOWED"
+	codeRateLimited         errorCode = "RATE_LIMITED"
+	codeInvalidFormat       errorCode = "INVALID_FORMAT"
+	codeImportTooLarge      errorCode = "IMPORT_TOO_LARGE"
+	// codeVersionConflict is only sent over the WebSocket, see ws.go
+	codeVersionConflict errorCode = "VERSION_CONFLICT"
+
+	codeUnauthenticated    errorCode = "UNAUTHENTICATED"
+	codeInvalidSession     errorCode = "INVALID_SESSION"
+	codeInvalidAPIKey      errorCode = "INVALID_API_KEY"
+	codeInsufficientScope  errorCode = "INSUFFICIENT_SCOPE"
+	codeInvalidUsername    errorCode = "INVALID_USERNAME"
+	codePasswordTooShort   errorCode = "PASSWORD_TOO_SHORT"
+	codePasswordTooLong    errorCode = "PASSWORD_TOO_LONG"
+	codeUsernameTaken      errorCode = "USERNAME_TAKEN"
+	codeInvalidCredentials errorCode = "INVALID_CREDENTIALS"
+
+	codeUnavailable errorCode = "SERVICE_UNAVAILABLE"
+	codeInternal    errorCode = "INTERNAL_ERROR"
+)
+
+// codeFromReason returns the code of a rejection logged under reason, for
+// validators such as validateTodoText that return the reason
+func codeFromReason(reason string) errorCode {
+	return errorCode(strings.ToUpper(reason))
+}
+
+// errorStatus is the HTTP status each code is sent with
+var errorStatus = map[errorCode]int{
+	codeInvalidJSON:         http.StatusBadRequest,
+	codeInvalidRequest:      http.StatusBadRequest,
+	codeEmptyText:           http.StatusBadRequest,
+	codeTextTooLong:         http.StatusBadRequest,
+	codeModerationFailed:    http.StatusUnprocessableEntity,
+	codeInvalidID:           http.StatusBadRequest,
+	codeInvalidListOptions:  http.StatusBadRequest,
+	codeInvalidAuditOptions: http.StatusBadRequest,
+	codeTodoNotFound:        http.StatusNotFound,
+	codeMethodNotAllowed:    http.StatusMethodNotAllowed,
+	codeRateLimited:         http.StatusTooManyRequests,
+	codeInvalidFormat:       http.StatusBadRequest,
+	codeImportTooLarge:      http.StatusRequestEntityTooLarge,
+	codeVersionConflict:     http.StatusConflict,
+
+	codeUnauthenticated:    http.StatusUnauthorized,
+	codeInvalidSession:     http.StatusUnauthorized,
+	codeInvalidAPIKey:      http.StatusUnauthorized,
+	codeInsufficientScope:  http.StatusForbidden,
+	codeInvalidUsername:    http.StatusBadRequest,
+	codePasswordTooShort:   http.StatusBadRequest,
+	codePasswordTooLong:    http.StatusBadRequest,
+	codeUsernameTaken:      http.StatusConflict,
+	codeInvalidCredentials: http.StatusUnauthorized,
+
+	codeUnavailable: http.StatusServiceUnavailable,
+	codeInternal:    http.StatusInternalServerError,
+}
+
+// apiError is a failure reported to the client, see writeProblem
+type apiError struct {
+	Code   errorCode
+	Detail string
+	// Field is a JSON pointer to the request body field at fault, if any
+	Field string
+	// Rule is the moderation rule that rejected a text
+	Rule string
+	// Errors lists everything wrong with a request body, see decodeRequest
+	Errors []fieldError
+}
+
+func (e *apiError) Error() string {
+	return string(e.Code) + ": " + e.Detail
+}
+
+// errInternal is sent for failures the client cannot do anything about; the
+// cause is only logged
+var errInternal = &apiError{Code: codeInternal, Detail: "Internal server error"}
+
+// Problem is an RFC 7807 problem details object, the body of every error
+// response. Type is always about:blank, so Title is the status text; Code
+// tells failures with the same status apart. RequestID matches the
+// X-Request-ID header and the request_id of the log lines.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Code      errorCode    `json:"code"`
+	Detail    string       `json:"detail,omitempty"`
+	Field     string       `json:"field,omitempty"`
+	Rule      string       `json:"rule,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+// writeProblem sends err as an application/problem+json response
+func writeProblem(w http.ResponseWriter, r *http.Request, err *apiError) {
+	status, ok := errorStatus[err.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      err.Code,
+		Detail:    err.Detail,
+		Field:     err.Field,
+		Rule:      err.Rule,
+		Instance:  r.URL.Path,
+		RequestID: requestIDFromContext(r.Context()),
+		Errors:    err.Errors,
+	})
+}
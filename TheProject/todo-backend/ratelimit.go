@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often buckets that have filled up again are
+// dropped, so clients seen once do not stay in memory
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the tokens of one client; a request takes one
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client. Buckets refill at rate tokens
+// per second up to burst, so a client can send burst requests at once and
+// rate requests per second after that. Limits are per replica.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// newRateLimiterFromEnv builds the limiter of POST /todos from
+// RATE_LIMIT_CREATE_PER_MINUTE and RATE_LIMIT_CREATE_BURST. A rate of 0
+// turns rate limiting off and returns nil.
+func newRateLimiterFromEnv() *rateLimiter {
+	perMinute := intFromEnv("RATE_LIMIT_CREATE_PER_MINUTE", 30)
+	if perMinute == 0 {
+		slog.Info("Rate limiting of todo creation disabled")
+		return nil
+	}
+	burst := max(intFromEnv("RATE_LIMIT_CREATE_BURST", 10), 1)
+
+	slog.Info("Rate limiting todo creation", "per_minute", perMinute, "burst", burst)
+	return newRateLimiter(perMinute, burst)
+}
+
+// createLimiter limits todo creation per client, nil when disabled
+var createLimiter *rateLimiter
+
+// Allow takes a token from the bucket of key. When it is empty it returns
+// false and how long until the next token.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops the buckets that are full again, which behave the same as no
+// bucket. The caller holds the lock.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Clients returns how many clients currently have a bucket
+func (l *rateLimiter) Clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// rateLimit rejects requests with 429 once their client used up its bucket
+// in limiter. It runs after authenticate, since clients are told apart by
+// their session or API key where there is one. A nil limiter lets
+// everything through.
+func rateLimit(limiter *rateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			handler(w, r)
+			return
+		}
+
+		key, kind := rateLimitKey(r)
+		ok, wait := limiter.Allow(key)
+		if ok {
+			handler(w, r)
+			return
+		}
+
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		rateLimitedTotal.WithLabelValues(kind).Inc()
+		loggerFromContext(r.Context()).Warn("REJECT", "reason", "rate_limited", "client", key,
+			"retry_after_seconds", retryAfter)
+
+		enableCORS(w)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeProblem(w, r, &apiError{Code: codeRateLimited,
+			Detail: fmt.Sprintf("Too many requests, retry in %d seconds", retryAfter)})
+	}
+}
+
+// rateLimitKey identifies the client of a request for rate limiting, and
+// returns what kind of client it is for the metrics: a logged in user, a
+// browser whose request a trusted proxy such as the frontend relayed, an
+// API key, or any other caller by its IP address.
+func rateLimitKey(r *http.Request) (key, kind string) {
+	if user, ok := userFromContext(r.Context()); ok {
+		return "user:" + strconv.Itoa(user.ID), "user"
+	}
+
+	ip, forwarded := clientIP(r)
+	if forwarded {
+		return "ip:" + ip, "ip"
+	}
+	if key, ok := apiKeyFromContext(r.Context()); ok {
+		return "api_key:" + strconv.Itoa(key.ID), "api_key"
+	}
+	return "ip:" + ip, "ip"
+}
+
+// trustedProxies are the networks allowed to name the client of a request
+// in X-Forwarded-For, from the comma separated TRUSTED_PROXIES list of
+// addresses and CIDR ranges
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(value string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				slog.Warn("Ignoring invalid trusted proxy", "value", entry, "error", err)
+				continue
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			slog.Warn("Ignoring invalid trusted proxy", "value", entry, "error", err)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// isTrustedProxy reports whether ip is in TRUSTED_PROXIES
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of a request. X-Forwarded-For
+// is only believed as far as it was added by trusted proxies: it is read from
+// the right, and the first address not in TRUSTED_PROXIES is the client.
+// forwarded reports whether the address came from X-Forwarded-For.
+func clientIP(r *http.Request) (ip string, forwarded bool) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip, false
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		ip, forwarded = hop, true
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip, forwarded
+}
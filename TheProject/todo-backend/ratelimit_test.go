@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestCreateRateLimit(t *testing.T) {
+	api := newTestAPI(t)
+	createLimiter = newRateLimiter(1, 2)
+
+	api.createTodo("First")
+	api.createTodo("Second")
+	rec := api.do("POST", "/todos", `{"text":"Third"}`)
+	expectProblem(t, rec, http.StatusTooManyRequests, codeRateLimited)
+	if retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 60 {
+		t.Fatalf("Retry-After = %q, want 1 to 60 seconds", rec.Header().Get("Retry-After"))
+	}
+
+	// Imports take from the same bucket
+	expectProblem(t, api.do("POST", "/todos/import", `[{"text":"Imported"}]`),
+		http.StatusTooManyRequests, codeRateLimited)
+
+	// Reads are not limited, and other clients have their own bucket
+	if rec := api.do("GET", "/todos", ""); rec.Code != http.StatusOK {
+		t.Fatalf("list: status %d: %s", rec.Code, rec.Body)
+	}
+	alice := api.signup("alice")
+	api.createTodo("Alice's", "Authorization", alice)
+}
+
+func TestClientIP(t *testing.T) {
+	old := trustedProxies
+	t.Cleanup(func() { trustedProxies = old })
+	trustedProxies = parseTrustedProxies("10.0.0.0/8, 192.0.2.1, not-an-address")
+	if len(trustedProxies) != 2 {
+		t.Fatalf("trusted proxies = %v, want the two valid entries", trustedProxies)
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  string
+		wantIP        string
+		wantForwarded bool
+	}{
+		{"direct", "203.0.113.7:1234", "", "203.0.113.7", false},
+		{"untrusted peer", "203.0.113.7:1234", "198.51.100.1", "203.0.113.7", false},
+		{"trusted proxy", "192.0.2.1:1234", "198.51.100.1", "198.51.100.1", true},
+		{"proxy chain", "192.0.2.1:1234", "198.51.100.1, 10.1.2.3", "198.51.100.1", true},
+		{"spoofed hop", "192.0.2.1:1234", "1.2.3.4, 198.51.100.1", "198.51.100.1", true},
+		{"garbage", "192.0.2.1:1234", "nonsense", "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/todos", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			ip, forwarded := clientIP(r)
+			if ip != tt.wantIP || forwarded != tt.wantForwarded {
+				t.Fatalf("clientIP = %s, %v, want %s, %v", ip, forwarded, tt.wantIP, tt.wantForwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// shuttingDown is set once a shutdown signal arrives. /readyz then reports
+// 503, so Kubernetes takes the pod out of the service before it stops
+// accepting connections.
+var shuttingDown atomic.Bool
+
+// serve runs server until it fails or the process receives SIGTERM or
+// SIGINT. On a signal it fails readiness, waits SHUTDOWN_DELAY for the
+// endpoints to be updated, then stops accepting connections and waits up to
+// SHUTDOWN_TIMEOUT for in-flight requests to finish.
+func serve(server *http.Server) error {
+	delay := durationFromEnv("SHUTDOWN_DELAY", 5*time.Second)
+	timeout := durationFromEnv("SHUTDOWN_TIMEOUT", 20*time.Second)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// A second signal kills the process straight away
+	stop()
+
+	shuttingDown.Store(true)
+	slog.Info("Shutdown signal received, draining connections",
+		"delay", delay.String(), "timeout", timeout.String())
+	time.Sleep(delay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to drain connections: %v", err)
+	}
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	slog.Info("All connections drained")
+	return nil
+}
+
+// durationFromEnv parses a duration such as 10s from the environment,
+// falling back to defaultValue when it is unset or invalid
+func durationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		slog.Warn("Invalid duration, using default", "key", key, "value", value, "default", defaultValue.String())
+		return defaultValue
+	}
+	return duration
+}
+
+// intervalFromEnv parses the period of a time.Ticker from the environment,
+// falling back to defaultValue when it is unset. Unlike durationFromEnv it
+// reports an invalid or non-positive value as an error, so a misconfigured
+// interval stops the backend at startup instead of panicking the ticker or
+// being replaced behind the operator's back.
+func intervalFromEnv(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as %s, got %q", key, defaultValue, value)
+	}
+	return interval, nil
+}
+
+// intFromEnv parses a non-negative number from the environment, falling back
+// to defaultValue when it is unset or invalid
+func intFromEnv(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		slog.Warn("Invalid number, using default", "key", key, "value", value, "default", defaultValue)
+		return defaultValue
+	}
+	return number
+}
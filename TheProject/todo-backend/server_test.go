@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIntervalFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", time.Minute, true},
+		{"10s", 10 * time.Second, true},
+		{"0", 0, false},
+		{"-5s", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("TEST_INTERVAL", tt.value)
+			got, err := intervalFromEnv("TEST_INTERVAL", time.Minute)
+			if (err == nil) != tt.ok || got != tt.want {
+				t.Fatalf("intervalFromEnv = %s, %v, want %s, ok %v", got, err, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// errTodoNotFound is returned by a TodoStore when no todo has the given ID
+var errTodoNotFound = errors.New("todo not found")
+
+// errVersionConflict is returned by a TodoStore when a change expected a
+// different version of the todo, because someone else changed it first
+var errVersionConflict = errors.New("todo was changed concurrently")
+
+// TodoStore persists todos and the users owning them. Handlers only talk to
+// the store, so the backend can run against Postgres in the cluster, SQLite
+// on single-node dev clusters and in memory locally and in tests.
+//
+// Every todo belongs to the list of one owner, the ID of a user or
+// publicBoard. Todos on another owner's list are reported as not found.
+// Deleted todos go to the trash; apart from Trash, Restore and PurgeTrash
+// the methods act as if they were gone.
+type TodoStore interface {
+	// List returns one page of todos matching opts, and the cursor of the
+	// next page or nil when this is the last one
+	List(ctx context.Context, opts listOptions) ([]Todo, *todoCursor, error)
+	Get(ctx context.Context, owner, id int) (Todo, error)
+	Create(ctx context.Context, owner int, text, priority string) (Todo, error)
+	Update(ctx context.Context, owner, id int, update TodoUpdate) (Todo, error)
+	// Delete moves a todo to the trash and returns it with DeletedAt set.
+	// When version is not nil the todo is only deleted at that version.
+	Delete(ctx context.Context, owner, id int, version *int) (Todo, error)
+	// Trash returns the owner's deleted todos, most recently deleted first
+	Trash(ctx context.Context, owner int) ([]Todo, error)
+	// Restore takes a todo out of the trash, bumping its version, or fails
+	// with errTodoNotFound when the owner has no such todo in the trash
+	Restore(ctx context.Context, owner, id int) (Todo, error)
+	// PurgeTrash permanently removes the todos of all owners deleted before
+	// the given time
+	PurgeTrash(ctx context.Context, before time.Time) (int64, error)
+	// Export calls fn with every todo of owner, oldest first, and stops at
+	// the first error fn returns
+	Export(ctx context.Context, owner int, fn func(Todo) error) error
+	// Import adds todos to the owner's list in a single transaction, keeping
+	// their text, priority, done state and timestamps but giving them new IDs
+	// and version 1. Either all of them are added or none.
+	Import(ctx context.Context, owner int, todos []Todo) ([]Todo, error)
+	// AuditLog returns the owner's audit entries matching opts, oldest
+	// first, and whether more follow. Every method changing a todo adds an
+	// entry in the same transaction, see AuditEntry.
+	AuditLog(ctx context.Context, opts auditOptions) ([]AuditEntry, bool, error)
+	// Count returns the number of todos of all owners
+	Count(ctx context.Context) (int, error)
+	// State summarizes the owner's todos; it changes with every create,
+	// update, delete, restore and import on that list
+	State(ctx context.Context, owner int) (storeState, error)
+
+	// CreateUser adds a user, failing with errUsernameTaken when the name is
+	// in use
+	CreateUser(ctx context.Context, username, passwordHash string) (User, error)
+	// GetUserByName returns a user and their password hash
+	GetUserByName(ctx context.Context, username string) (User, string, error)
+	CreateSession(ctx context.Context, session Session) error
+	// GetSessionUser returns the user of an unexpired session, or
+	// errSessionNotFound
+	GetSessionUser(ctx context.Context, tokenHash string) (User, error)
+	// DeleteSession removes a session, and any expired ones along with it
+	DeleteSession(ctx context.Context, tokenHash string) error
+
+	// CreateAPIKey stores a new key under the hash of its secret
+	CreateAPIKey(ctx context.Context, key APIKey, keyHash string) (APIKey, error)
+	// ListAPIKeys returns every key, revoked ones included, oldest first
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// GetAPIKey returns the unrevoked key with the given hash, or
+	// errAPIKeyNotFound
+	GetAPIKey(ctx context.Context, keyHash string) (APIKey, error)
+	// TouchAPIKey records that a key was used at the given time
+	TouchAPIKey(ctx context.Context, id int, at time.Time) error
+	// RevokeAPIKey disables a key for good, failing with errAPIKeyNotFound
+	// when no unrevoked key has the ID
+	RevokeAPIKey(ctx context.Context, id int) error
+
+	// Ping reports whether the underlying storage is reachable
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// TodoUpdate lists the fields to change on a todo; nil fields are left as is.
+// Setting Done to true stamps completed_at, setting it to false clears it.
+// When Version is set the update only applies to that version of the todo.
+type TodoUpdate struct {
+	Text     *string
+	Priority *string
+	Done     *bool
+	Version  *int
+}
+
+// storeState summarizes the todos of one owner. Version is a counter of the
+// list that every create, update, delete, restore and import raises in the
+// same transaction, so it moves whenever the list shows something else.
+// Purging the trash leaves it alone, since no list shows the trash.
+type storeState struct {
+	Count   int
+	Version int64
+}
+
+// newStoreFromEnv builds the store selected by DATABASE_URL or
+// STORAGE_BACKEND (postgres, sqlite or memory) and returns it together with
+// the backend name
+func newStoreFromEnv() (TodoStore, string, error) {
+	backend := getEnvOrDefault("STORAGE_BACKEND", "postgres")
+
+	switch {
+	case os.Getenv("DATABASE_URL") != "", backend == "postgres", backend == "sqlite":
+		database, dialect, err := initDB()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to initialize database: %v", err)
+		}
+
+		// Apply pending schema migrations unless an init container already does
+		if getEnvOrDefault("DB_AUTO_MIGRATE", "true") == "true" {
+			if err := migrateSchema(database, dialect); err != nil {
+				database.Close()
+				return nil, "", fmt.Errorf("failed to migrate database schema: %v", err)
+			}
+		}
+
+		s := newSQLStore(database, dialect)
+		s.outbox = outboxEnabled()
+		s.outboxPublicOnly = outboxPublicBoardOnly()
+		return s, dialect.name, nil
+
+	case backend == "memory":
+		slog.Warn("Using in-memory storage, todos are lost when the process exits")
+		s := newMemoryStore()
+		s.outbox = outboxEnabled()
+		s.outboxPublicOnly = outboxPublicBoardOnly()
+		return s, backend, nil
+
+	default:
+		return nil, "", fmt.Errorf("unknown STORAGE_BACKEND %q, expected postgres, sqlite or memory", backend)
+	}
+}
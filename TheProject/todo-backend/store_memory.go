@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a TodoStore that keeps todos in process memory. It is meant
+// for local development and tests; nothing survives a restart.
+type memoryStore struct {
+	mu     sync.RWMutex
+	todos  map[int]Todo
+	nextID int
+
+	users      map[int]memoryUser
+	nextUserID int
+	sessions   map[string]Session
+
+	// apiKeys is keyed by the hash of the secret
+	apiKeys      map[string]APIKey
+	nextAPIKeyID int
+
+	// outbox records every change in outboxEntries under the same lock as
+	// the change itself, see outboxStore. outboxPublicOnly leaves out the
+	// changes to users' lists.
+	outbox           bool
+	outboxPublicOnly bool
+	outboxEntries    []memoryOutboxEntry
+	nextOutboxID     int64
+
+	// auditEntries only ever grows, see AuditEntry
+	auditEntries []AuditEntry
+
+	// listVersions is the version of each owner's list, see storeState
+	listVersions map[int]int64
+}
+
+// memoryUser is a user with its password hash
+type memoryUser struct {
+	User
+	passwordHash string
+}
+
+// memoryOutboxEntry is an outbox entry with its delivery state
+type memoryOutboxEntry struct {
+	outboxEntry
+	nextAttemptAt time.Time
+	sentAt        *time.Time
+	lastError     string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		todos:        make(map[int]Todo),
+		nextID:       1,
+		users:        make(map[int]memoryUser),
+		nextUserID:   1,
+		sessions:     make(map[string]Session),
+		apiKeys:      make(map[string]APIKey),
+		nextAPIKeyID: 1,
+		listVersions: make(map[int]int64),
+	}
+}
+
+func (s *memoryStore) List(ctx context.Context, opts listOptions) ([]Todo, *todoCursor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var terms []string
+	if opts.Query != "" {
+		terms = strings.Fields(strings.ToLower(opts.Query))
+	}
+
+	var todos []Todo
+	for _, todo := range s.todos {
+		if todo.OwnerID != opts.Owner || todo.DeletedAt != nil {
+			continue
+		}
+		if opts.Done != nil && todo.Done != *opts.Done {
+			continue
+		}
+		if !containsAllTerms(todo.Text, terms) {
+			continue
+		}
+		if opts.Cursor != nil {
+			// Keep only todos that come after the cursor in the requested order
+			cmp := compareCursors(cursorAfter(todo, opts), *opts.Cursor)
+			if (opts.Order == "asc" && cmp <= 0) || (opts.Order != "asc" && cmp >= 0) {
+				continue
+			}
+		}
+		todos = append(todos, withCreated(todo))
+	}
+
+	sort.Slice(todos, func(i, j int) bool {
+		cmp := compareCursors(cursorAfter(todos[i], opts), cursorAfter(todos[j], opts))
+		if opts.Order == "asc" {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+
+	if len(todos) > opts.Limit {
+		todos = todos[:opts.Limit]
+		next := cursorAfter(todos[len(todos)-1], opts)
+		return todos, &next, nil
+	}
+	return todos, nil, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, owner, id int) (Todo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	todo, ok := s.liveTodo(owner, id)
+	if !ok {
+		return Todo{}, errTodoNotFound
+	}
+	return withCreated(todo), nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, owner int, text, priority string) (Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	todo := Todo{
+		ID:        s.nextID,
+		Text:      text,
+		Priority:  priority,
+		CreatedAt: time.Now().UTC(),
+		Version:   1,
+		OwnerID:   owner,
+	}
+	s.todos[todo.ID] = todo
+	s.nextID++
+
+	todo = withCreated(todo)
+	s.listVersions[owner]++
+	s.recordAudit(ctx, auditCreate, nil, &todo)
+	s.recordChange(ctx, eventTodoCreated, todo)
+	return todo, nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, owner, id int, update TodoUpdate) (Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	todo, ok := s.liveTodo(owner, id)
+	if !ok {
+		return Todo{}, errTodoNotFound
+	}
+	if update.Version != nil && *update.Version != todo.Version {
+		return Todo{}, errVersionConflict
+	}
+	before := withCreated(todo)
+
+	if update.Text != nil {
+		todo.Text = *update.Text
+	}
+	if update.Priority != nil {
+		todo.Priority = *update.Priority
+	}
+	if update.Done != nil {
+		todo.Done = *update.Done
+		if !todo.Done {
+			todo.CompletedAt = nil
+		} else if todo.CompletedAt == nil {
+			now := time.Now().UTC()
+			todo.CompletedAt = &now
+		}
+	}
+	todo.Version++
+	s.todos[id] = todo
+
+	todo = withCreated(todo)
+	s.listVersions[owner]++
+	s.recordAudit(ctx, auditUpdate, &before, &todo)
+	s.recordChange(ctx, eventTodoUpdated, todo)
+	return todo, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, owner, id int, version *int) (Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	todo, ok := s.liveTodo(owner, id)
+	if !ok {
+		return Todo{}, errTodoNotFound
+	}
+	if version != nil && *version != todo.Version {
+		return Todo{}, errVersionConflict
+	}
+	before := withCreated(todo)
+	now := time.Now().UTC()
+	todo.DeletedAt = &now
+	s.todos[id] = todo
+
+	todo = withCreated(todo)
+	s.listVersions[owner]++
+	s.recordAudit(ctx, auditDelete, &before, &todo)
+	s.recordChange(ctx, eventTodoDeleted, todo)
+	return todo, nil
+}
+
+func (s *memoryStore) Trash(ctx context.Context, owner int) ([]Todo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var todos []Todo
+	for _, todo := range s.todos {
+		if todo.OwnerID == owner && todo.DeletedAt != nil {
+			todos = append(todos, withCreated(todo))
+		}
+	}
+	sort.Slice(todos, func(i, j int) bool {
+		if !todos[i].DeletedAt.Equal(*todos[j].DeletedAt) {
+			return todos[i].DeletedAt.After(*todos[j].DeletedAt)
+		}
+		return todos[i].ID > todos[j].ID
+	})
+	return todos, nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, owner, id int) (Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	todo, ok := s.todos[id]
+	if !ok || todo.OwnerID != owner || todo.DeletedAt == nil {
+		return Todo{}, errTodoNotFound
+	}
+	before := withCreated(todo)
+	todo.DeletedAt = nil
+	todo.Version++
+	s.todos[id] = todo
+
+	todo = withCreated(todo)
+	s.listVersions[owner]++
+	s.recordAudit(ctx, auditRestore, &before, &todo)
+	s.recordChange(ctx, eventTodoRestored, todo)
+	return todo, nil
+}
+
+func (s *memoryStore) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for id, todo := range s.todos {
+		if todo.DeletedAt != nil && todo.DeletedAt.Before(before) {
+			delete(s.todos, id)
+			purged++
+			// The audit log keeps the history of purged todos
+			todo = withCreated(todo)
+			s.recordAudit(ctx, auditPurge, &todo, nil)
+		}
+	}
+	return purged, nil
+}
+
+// liveTodo returns the owner's todo with the given ID unless it is in the
+// trash. The caller holds the lock.
+func (s *memoryStore) liveTodo(owner, id int) (Todo, bool) {
+	todo, ok := s.todos[id]
+	if !ok || todo.OwnerID != owner || todo.DeletedAt != nil {
+		return Todo{}, false
+	}
+	return todo, true
+}
+
+func (s *memoryStore) Export(ctx context.Context, owner int, fn func(Todo) error) error {
+	// Copied, so fn runs without holding the lock
+	s.mu.RLock()
+	var todos []Todo
+	for _, todo := range s.todos {
+		if todo.OwnerID == owner && todo.DeletedAt == nil {
+			todos = append(todos, todo)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(todos, func(i, j int) bool { return todos[i].ID < todos[j].ID })
+	for _, todo := range todos {
+		if err := fn(withCreated(todo)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Import(ctx context.Context, owner int, todos []Todo) ([]Todo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	imported := make([]Todo, 0, len(todos))
+	for _, todo := range todos {
+		todo.ID = s.nextID
+		todo.Version = 1
+		todo.OwnerID = owner
+		s.todos[todo.ID] = todo
+		s.nextID++
+
+		todo = withCreated(todo)
+		s.recordAudit(ctx, auditCreate, nil, &todo)
+		s.recordChange(ctx, eventTodoCreated, todo)
+		imported = append(imported, todo)
+	}
+	s.listVersions[owner]++
+	return imported, nil
+}
+
+func (s *memoryStore) AuditLog(ctx context.Context, opts auditOptions) ([]AuditEntry, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// auditEntries is in ID order already
+	var entries []AuditEntry
+	for _, entry := range s.auditEntries {
+		if entry.OwnerID != opts.Owner || entry.ID <= opts.After {
+			continue
+		}
+		if opts.TodoID != 0 && entry.TodoID != opts.TodoID {
+			continue
+		}
+		if opts.Since != nil && entry.CreatedAt.Before(*opts.Since) {
+			continue
+		}
+		if len(entries) == opts.Limit {
+			return entries, true, nil
+		}
+		entries = append(entries, entry)
+	}
+	return entries, false, nil
+}
+
+func (s *memoryStore) Count(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, todo := range s.todos {
+		if todo.DeletedAt == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryStore) State(ctx context.Context, owner int) (storeState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := storeState{Version: s.listVersions[owner]}
+	for _, todo := range s.todos {
+		if todo.OwnerID == owner && todo.DeletedAt == nil {
+			state.Count++
+		}
+	}
+	return state, nil
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, username, passwordHash string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return User{}, errUsernameTaken
+		}
+	}
+
+	user := User{ID: s.nextUserID, Username: username, CreatedAt: time.Now().UTC()}
+	s.users[user.ID] = memoryUser{User: user, passwordHash: passwordHash}
+	s.nextUserID++
+	return user, nil
+}
+
+func (s *memoryStore) GetUserByName(ctx context.Context, username string) (User, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			return user.User, user.passwordHash, nil
+		}
+	}
+	return User{}, "", errUserNotFound
+}
+
+func (s *memoryStore) CreateSession(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.TokenHash] = session
+	return nil
+}
+
+func (s *memoryStore) GetSessionUser(ctx context.Context, tokenHash string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[tokenHash]
+	if !ok || !session.ExpiresAt.After(time.Now()) {
+		return User{}, errSessionNotFound
+	}
+	user, ok := s.users[session.UserID]
+	if !ok {
+		return User{}, errSessionNotFound
+	}
+	return user.User, nil
+}
+
+func (s *memoryStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for hash, session := range s.sessions {
+		if hash == tokenHash || !session.ExpiresAt.After(now) {
+			delete(s.sessions, hash)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CreateAPIKey(ctx context.Context, key APIKey, keyHash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.ID = s.nextAPIKeyID
+	s.apiKeys[keyHash] = key
+	s.nextAPIKeyID++
+	return key, nil
+}
+
+func (s *memoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []APIKey
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (s *memoryStore) GetAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.apiKeys[keyHash]
+	if !ok || key.RevokedAt != nil {
+		return APIKey{}, errAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryStore) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, key := range s.apiKeys {
+		if key.ID == id {
+			key.LastUsedAt = &at
+			s.apiKeys[hash] = key
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) RevokeAPIKey(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, key := range s.apiKeys {
+		if key.ID == id && key.RevokedAt == nil {
+			now := time.Now().UTC()
+			key.RevokedAt = &now
+			s.apiKeys[hash] = key
+			return nil
+		}
+	}
+	return errAPIKeyNotFound
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// recordAudit adds a change to the audit log. The caller holds the write
+// lock.
+func (s *memoryStore) recordAudit(ctx context.Context, action string, before, after *Todo) {
+	// A snapshot always marshals, so the error can be ignored
+	entry, _ := newAuditEntry(ctx, action, before, after)
+	entry.ID = int64(len(s.auditEntries)) + 1
+	s.auditEntries = append(s.auditEntries, entry)
+}
+
+// recordChange adds a change to the outbox, when enabled. The caller holds
+// the write lock.
+func (s *memoryStore) recordChange(ctx context.Context, eventType string, todo Todo) {
+	if !s.outbox || (s.outboxPublicOnly && todo.OwnerID != publicBoard) {
+		return
+	}
+
+	// A Todo always marshals, so the error can be ignored
+	entry, _ := newOutboxEntry(ctx, eventType, todo)
+	s.nextOutboxID++
+	entry.ID = s.nextOutboxID
+	s.outboxEntries = append(s.outboxEntries, memoryOutboxEntry{outboxEntry: entry, nextAttemptAt: entry.CreatedAt})
+}
+
+func (s *memoryStore) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]outboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	var entries []outboxEntry
+	for i := range s.outboxEntries {
+		if len(entries) == limit {
+			break
+		}
+		entry := &s.outboxEntries[i]
+		if entry.sentAt != nil || entry.nextAttemptAt.After(now) {
+			continue
+		}
+		entry.Attempts++
+		entry.nextAttemptAt = now.Add(lease)
+		entries = append(entries, entry.outboxEntry)
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) MarkOutboxSent(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry := s.findOutboxEntry(id); entry != nil {
+		now := time.Now().UTC()
+		entry.sentAt = &now
+		entry.lastError = ""
+	}
+	return nil
+}
+
+func (s *memoryStore) RetryOutboxLater(ctx context.Context, id int64, at time.Time, deliveryErr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry := s.findOutboxEntry(id); entry != nil {
+		entry.nextAttemptAt = at
+		entry.lastError = deliveryErr
+	}
+	return nil
+}
+
+func (s *memoryStore) PurgeOutbox(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.outboxEntries[:0]
+	for _, entry := range s.outboxEntries {
+		if entry.sentAt == nil || !entry.sentAt.Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+	purged := int64(len(s.outboxEntries) - len(kept))
+	s.outboxEntries = kept
+	return purged, nil
+}
+
+// findOutboxEntry returns the entry with the given ID, or nil once purged.
+// The caller holds the write lock.
+func (s *memoryStore) findOutboxEntry(id int64) *memoryOutboxEntry {
+	for i := range s.outboxEntries {
+		if s.outboxEntries[i].ID == id {
+			return &s.outboxEntries[i]
+		}
+	}
+	return nil
+}
+
+// withCreated refreshes the human readable Created field of a stored todo
+func withCreated(todo Todo) Todo {
+	todo.Created = formatCreatedTime(todo.CreatedAt)
+	return todo
+}
+
+// containsAllTerms is the in-memory stand-in for Postgres full-text search:
+// every search term has to appear in the text, ignoring case
+func containsAllTerms(text string, terms []string) bool {
+	text = strings.ToLower(text)
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
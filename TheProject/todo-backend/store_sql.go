@@ -0,0 +1,799 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// todoColumns is the column list every query returning a Todo selects, in the
+// order scanTodo expects them
+const todoColumns = "id, text, created_at, priority, done, completed_at, version, owner_id, deleted_at"
+
+// notDeleted restricts a query to todos that are not in the trash. Every
+// query except those of the trash itself has to include it.
+const notDeleted = "deleted_at IS NULL"
+
+// inTrash is the opposite of notDeleted
+const inTrash = "deleted_at IS NOT NULL"
+
+// ownerCondition matches the todos of the owner passed as the given
+// placeholder. The public board is stored as NULL, which idx_todos_owner
+// indexes as 0.
+func ownerCondition(placeholder string) string {
+	return "COALESCE(owner_id, 0) = " + placeholder
+}
+
+// ownerValue is what owner_id is set to for the todos of owner
+func ownerValue(owner int) interface{} {
+	if owner == publicBoard {
+		return nil
+	}
+	return owner
+}
+
+// sqlStore is the TodoStore backed by the todos table in Postgres or SQLite.
+// The queries are shared; dialect covers the places where the two differ.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	// outbox records every change in the outbox table, see outboxStore.
+	// outboxPublicOnly leaves out the changes to users' lists.
+	outbox           bool
+	outboxPublicOnly bool
+}
+
+func newSQLStore(db *sql.DB, dialect sqlDialect) *sqlStore {
+	return &sqlStore{db: db, dialect: dialect}
+}
+
+func (s *sqlStore) List(ctx context.Context, opts listOptions) ([]Todo, *todoCursor, error) {
+	query, args := buildListQuery(opts, s.dialect)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var todos []Todo
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		todos = append(todos, todo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// One extra row was fetched to find out whether another page exists
+	if len(todos) > opts.Limit {
+		todos = todos[:opts.Limit]
+		next := cursorAfter(todos[len(todos)-1], opts)
+		return todos, &next, nil
+	}
+	return todos, nil, nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, owner, id int) (Todo, error) {
+	todo, err := scanTodo(s.db.QueryRowContext(ctx,
+		"SELECT "+todoColumns+" FROM todos WHERE id = $1 AND "+ownerCondition("$2")+" AND "+notDeleted, id, owner))
+	if err == sql.ErrNoRows {
+		return Todo{}, errTodoNotFound
+	}
+	return todo, err
+}
+
+func (s *sqlStore) Create(ctx context.Context, owner int, text, priority string) (Todo, error) {
+	var todo Todo
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		todo, err = scanTodo(tx.QueryRowContext(ctx,
+			"INSERT INTO todos (text, priority, owner_id) VALUES ($1, $2, $3) RETURNING "+todoColumns,
+			text, priority, ownerValue(owner),
+		))
+		if err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, tx, auditCreate, nil, &todo); err != nil {
+			return err
+		}
+		if err := s.bumpListVersion(ctx, tx, owner); err != nil {
+			return err
+		}
+		return s.recordChange(ctx, tx, eventTodoCreated, todo)
+	})
+	return todo, err
+}
+
+func (s *sqlStore) Update(ctx context.Context, owner, id int, update TodoUpdate) (Todo, error) {
+	var todo Todo
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := s.lockTodo(ctx, tx, owner, id, notDeleted)
+		if err != nil {
+			return err
+		}
+
+		// COALESCE keeps the current value for every field that was not sent, and
+		// marking an already completed todo as done keeps its original completed_at
+		todo, err = scanTodo(tx.QueryRowContext(ctx,
+			`UPDATE todos SET
+				text = COALESCE($2, text),
+				priority = COALESCE($3, priority),
+				done = COALESCE($4, done),
+				completed_at = CASE
+					WHEN CAST($4 AS BOOLEAN) IS NULL THEN completed_at
+					WHEN $4 THEN COALESCE(completed_at, `+s.dialect.now+`)
+					ELSE NULL
+				END,
+				version = version + 1
+			WHERE id = $1 AND `+ownerCondition("$6")+` AND `+notDeleted+`
+				AND (CAST($5 AS INTEGER) IS NULL OR version = $5)
+			RETURNING `+todoColumns,
+			id, update.Text, update.Priority, update.Done, update.Version, owner,
+		))
+		if err == sql.ErrNoRows {
+			return s.missingTodoError(ctx, tx, owner, id)
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, tx, auditUpdate, &before, &todo); err != nil {
+			return err
+		}
+		if err := s.bumpListVersion(ctx, tx, owner); err != nil {
+			return err
+		}
+		return s.recordChange(ctx, tx, eventTodoUpdated, todo)
+	})
+	return todo, err
+}
+
+func (s *sqlStore) Delete(ctx context.Context, owner, id int, version *int) (Todo, error) {
+	var todo Todo
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		todo, err = scanTodo(tx.QueryRowContext(ctx,
+			`UPDATE todos SET deleted_at = `+s.dialect.now+`
+			WHERE id = $1 AND `+ownerCondition("$3")+` AND `+notDeleted+`
+				AND (CAST($2 AS INTEGER) IS NULL OR version = $2)
+			RETURNING `+todoColumns, id, version, owner))
+		if err == sql.ErrNoRows {
+			return s.missingTodoError(ctx, tx, owner, id)
+		}
+		if err != nil {
+			return err
+		}
+		// Deleting only sets deleted_at
+		before := todo
+		before.DeletedAt = nil
+		if err := s.recordAudit(ctx, tx, auditDelete, &before, &todo); err != nil {
+			return err
+		}
+		if err := s.bumpListVersion(ctx, tx, owner); err != nil {
+			return err
+		}
+		return s.recordChange(ctx, tx, eventTodoDeleted, todo)
+	})
+	return todo, err
+}
+
+// missingTodoError explains why a change to the todo with the given ID
+// matched no row: either the owner has no such todo, or it is at a
+// different version than the change expected
+func (s *sqlStore) missingTodoError(ctx context.Context, tx *sql.Tx, owner, id int) error {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM todos WHERE id = $1 AND "+ownerCondition("$2")+" AND "+notDeleted+")", id, owner,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errVersionConflict
+	}
+	return errTodoNotFound
+}
+
+func (s *sqlStore) Export(ctx context.Context, owner int, fn func(Todo) error) error {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+todoColumns+" FROM todos WHERE "+ownerCondition("$1")+" AND "+notDeleted+" ORDER BY id", owner)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(todo); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) Import(ctx context.Context, owner int, todos []Todo) ([]Todo, error) {
+	imported := make([]Todo, 0, len(todos))
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		stmt, err := tx.PrepareContext(ctx,
+			`INSERT INTO todos (text, priority, done, completed_at, created_at, owner_id)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING `+todoColumns)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, todo := range todos {
+			var completedAt interface{}
+			if todo.CompletedAt != nil {
+				completedAt = s.dialect.timeValue(*todo.CompletedAt)
+			}
+			created, err := scanTodo(stmt.QueryRowContext(ctx, todo.Text, todo.Priority, todo.Done,
+				completedAt, s.dialect.timeValue(todo.CreatedAt), ownerValue(owner)))
+			if err != nil {
+				return err
+			}
+			if err := s.recordAudit(ctx, tx, auditCreate, nil, &created); err != nil {
+				return err
+			}
+			if err := s.recordChange(ctx, tx, eventTodoCreated, created); err != nil {
+				return err
+			}
+			imported = append(imported, created)
+		}
+		return s.bumpListVersion(ctx, tx, owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
+
+func (s *sqlStore) Trash(ctx context.Context, owner int) ([]Todo, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+todoColumns+" FROM todos WHERE "+ownerCondition("$1")+" AND "+inTrash+`
+		ORDER BY deleted_at DESC, id DESC`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var todos []Todo
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return nil, err
+		}
+		todos = append(todos, todo)
+	}
+	return todos, rows.Err()
+}
+
+func (s *sqlStore) Restore(ctx context.Context, owner, id int) (Todo, error) {
+	var todo Todo
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		before, err := s.lockTodo(ctx, tx, owner, id, inTrash)
+		if err != nil {
+			return err
+		}
+		todo, err = scanTodo(tx.QueryRowContext(ctx,
+			`UPDATE todos SET deleted_at = NULL, version = version + 1
+			WHERE id = $1 RETURNING `+todoColumns, id))
+		if err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, tx, auditRestore, &before, &todo); err != nil {
+			return err
+		}
+		if err := s.bumpListVersion(ctx, tx, owner); err != nil {
+			return err
+		}
+		return s.recordChange(ctx, tx, eventTodoRestored, todo)
+	})
+	return todo, err
+}
+
+func (s *sqlStore) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	var purged []Todo
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			"DELETE FROM todos WHERE "+inTrash+" AND deleted_at < $1 RETURNING "+todoColumns,
+			s.dialect.timeValue(before))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			todo, err := scanTodo(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			purged = append(purged, todo)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// The audit log keeps the history of purged todos
+		for i := range purged {
+			if err := s.recordAudit(ctx, tx, auditPurge, &purged[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(purged)), nil
+}
+
+func (s *sqlStore) AuditLog(ctx context.Context, opts auditOptions) ([]AuditEntry, bool, error) {
+	var conditions []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions = append(conditions, ownerCondition(arg(opts.Owner)), "id > "+arg(opts.After))
+	if opts.TodoID != 0 {
+		conditions = append(conditions, "todo_id = "+arg(opts.TodoID))
+	}
+	if opts.Since != nil {
+		conditions = append(conditions, "created_at >= "+arg(s.dialect.timeValue(*opts.Since)))
+	}
+
+	// One extra row tells whether another page exists
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, todo_id, owner_id, actor, client_ip, action, before_state, after_state, request_id, created_at
+		FROM audit_log WHERE `+strings.Join(conditions, " AND ")+" ORDER BY id LIMIT "+arg(opts.Limit+1),
+		args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		var ownerID sql.NullInt64
+		var before, after sql.NullString
+		err := rows.Scan(&entry.ID, &entry.TodoID, &ownerID, &entry.Actor, &entry.ClientIP, &entry.Action,
+			&before, &after, &entry.RequestID, &entry.CreatedAt)
+		if err != nil {
+			return nil, false, err
+		}
+		entry.OwnerID = int(ownerID.Int64)
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(entries) > opts.Limit {
+		return entries[:opts.Limit], true, nil
+	}
+	return entries, false, nil
+}
+
+func (s *sqlStore) Count(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM todos WHERE "+notDeleted).Scan(&count)
+	return count, err
+}
+
+func (s *sqlStore) State(ctx context.Context, owner int) (storeState, error) {
+	var state storeState
+	err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE((SELECT version FROM list_versions WHERE owner_id = $1), 0)
+		FROM todos WHERE `+ownerCondition("$1")+" AND "+notDeleted,
+		owner,
+	).Scan(&state.Count, &state.Version)
+	return state, err
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, username, passwordHash string) (User, error) {
+	user := User{Username: username, CreatedAt: time.Now().UTC()}
+	err := s.db.QueryRowContext(ctx,
+		"INSERT INTO users (username, password_hash, created_at) VALUES ($1, $2, $3) RETURNING id",
+		username, passwordHash, s.dialect.timeValue(user.CreatedAt),
+	).Scan(&user.ID)
+	if isUniqueViolation(err) {
+		return User{}, errUsernameTaken
+	}
+	return user, err
+}
+
+func (s *sqlStore) GetUserByName(ctx context.Context, username string) (User, string, error) {
+	var user User
+	var passwordHash string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, username, created_at, password_hash FROM users WHERE username = $1", username,
+	).Scan(&user.ID, &user.Username, &user.CreatedAt, &passwordHash)
+	if err == sql.ErrNoRows {
+		return User{}, "", errUserNotFound
+	}
+	return user, passwordHash, err
+}
+
+func (s *sqlStore) CreateSession(ctx context.Context, session Session) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		session.TokenHash, session.UserID, s.dialect.timeValue(session.CreatedAt),
+		s.dialect.timeValue(session.ExpiresAt))
+	return err
+}
+
+func (s *sqlStore) GetSessionUser(ctx context.Context, tokenHash string) (User, error) {
+	var user User
+	err := s.db.QueryRowContext(ctx,
+		`SELECT users.id, users.username, users.created_at
+		FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE sessions.token_hash = $1 AND sessions.expires_at > $2`,
+		tokenHash, s.dialect.timeValue(time.Now().UTC()),
+	).Scan(&user.ID, &user.Username, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return User{}, errSessionNotFound
+	}
+	return user, err
+}
+
+func (s *sqlStore) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM sessions WHERE token_hash = $1 OR expires_at <= $2",
+		tokenHash, s.dialect.timeValue(time.Now().UTC()))
+	return err
+}
+
+// apiKeyColumns are the columns scanAPIKey reads, in order
+const apiKeyColumns = "id, name, key_prefix, scopes, owner_id, created_at, last_used_at, revoked_at"
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, key APIKey, keyHash string) (APIKey, error) {
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO api_keys (name, key_hash, key_prefix, scopes, owner_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		key.Name, keyHash, key.Prefix, strings.Join(key.Scopes, ","), ownerValue(key.OwnerID),
+		s.dialect.timeValue(key.CreatedAt),
+	).Scan(&key.ID)
+	return key, err
+}
+
+func (s *sqlStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) GetAPIKey(ctx context.Context, keyHash string) (APIKey, error) {
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", keyHash))
+	if err == sql.ErrNoRows {
+		return APIKey{}, errAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *sqlStore) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE api_keys SET last_used_at = $2 WHERE id = $1",
+		id, s.dialect.timeValue(at))
+	return err
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, id int) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL",
+		id, s.dialect.timeValue(time.Now().UTC()))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// scanAPIKey reads a row selected with apiKeyColumns into an APIKey
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var ownerID sql.NullInt64
+	var lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &ownerID, &key.CreatedAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	key.OwnerID = int(ownerID.Int64)
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+// isUniqueViolation reports whether err comes from a UNIQUE constraint, in
+// the wording of either Postgres or SQLite
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "duplicate key") || strings.Contains(message, "unique constraint")
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// withTx runs fn in a transaction, committing only if fn succeeds. fn's error
+// is returned unchanged.
+func (s *sqlStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordChange adds a change to the outbox as part of tx, when enabled
+func (s *sqlStore) recordChange(ctx context.Context, tx *sql.Tx, eventType string, todo Todo) error {
+	if !s.outbox || (s.outboxPublicOnly && todo.OwnerID != publicBoard) {
+		return nil
+	}
+
+	entry, err := newOutboxEntry(ctx, eventType, todo)
+	if err != nil {
+		return err
+	}
+
+	createdAt := s.dialect.timeValue(entry.CreatedAt)
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO outbox (event_type, payload, request_id, created_at, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		entry.EventType, string(entry.Payload), entry.RequestID, createdAt, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to write outbox: %v", err)
+	}
+	return nil
+}
+
+// lockTodo reads the owner's todo with the given ID as it is before a
+// change in tx, keeping others from changing it until tx ends. condition is
+// notDeleted or inTrash.
+func (s *sqlStore) lockTodo(ctx context.Context, tx *sql.Tx, owner, id int, condition string) (Todo, error) {
+	todo, err := scanTodo(tx.QueryRowContext(ctx,
+		"SELECT "+todoColumns+" FROM todos WHERE id = $1 AND "+ownerCondition("$2")+" AND "+condition+s.dialect.forUpdate,
+		id, owner))
+	if err == sql.ErrNoRows {
+		return Todo{}, errTodoNotFound
+	}
+	return todo, err
+}
+
+// bumpListVersion raises the version of owner's list as part of tx, see
+// storeState. The row lock it takes keeps changes to one list in the order
+// of their versions.
+func (s *sqlStore) bumpListVersion(ctx context.Context, tx *sql.Tx, owner int) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO list_versions (owner_id, version) VALUES ($1, 1)
+		ON CONFLICT (owner_id) DO UPDATE SET version = list_versions.version + 1`, owner)
+	if err != nil {
+		return fmt.Errorf("failed to bump list version: %v", err)
+	}
+	return nil
+}
+
+// recordAudit adds a change to the audit log as part of tx
+func (s *sqlStore) recordAudit(ctx context.Context, tx *sql.Tx, action string, before, after *Todo) error {
+	entry, err := newAuditEntry(ctx, action, before, after)
+	if err != nil {
+		return err
+	}
+
+	// Absent states are stored as NULL
+	state := func(raw json.RawMessage) interface{} {
+		if raw == nil {
+			return nil
+		}
+		return string(raw)
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO audit_log (todo_id, owner_id, actor, client_ip, action, before_state, after_state, request_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		entry.TodoID, ownerValue(entry.OwnerID), entry.Actor, entry.ClientIP, entry.Action,
+		state(entry.Before), state(entry.After), entry.RequestID, s.dialect.timeValue(entry.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]outboxEntry, error) {
+	now := time.Now().UTC()
+
+	// Claiming pushes next_attempt_at past the lease, so other replicas skip
+	// the entries while this one delivers them
+	rows, err := s.db.QueryContext(ctx,
+		`UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $1
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE sent_at IS NULL AND next_attempt_at <= $2
+			ORDER BY id LIMIT $3`+s.dialect.skipLocked+`
+		)
+		RETURNING id, event_type, payload, request_id, created_at, attempts`,
+		s.dialect.timeValue(now.Add(lease)), s.dialect.timeValue(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		var payload string
+		err := rows.Scan(&entry.ID, &entry.EventType, &payload, &entry.RequestID, &entry.CreatedAt, &entry.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		entry.Payload = []byte(payload)
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not keep the subquery's order
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+func (s *sqlStore) MarkOutboxSent(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE outbox SET sent_at = $2, last_error = NULL WHERE id = $1",
+		id, s.dialect.timeValue(time.Now().UTC()))
+	return err
+}
+
+func (s *sqlStore) RetryOutboxLater(ctx context.Context, id int64, at time.Time, deliveryErr string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE outbox SET next_attempt_at = $2, last_error = $3 WHERE id = $1",
+		id, s.dialect.timeValue(at), deliveryErr)
+	return err
+}
+
+func (s *sqlStore) PurgeOutbox(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < $1",
+		s.dialect.timeValue(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// buildListQuery turns list options into a keyset-paginated SELECT. Rows are
+// ordered by the sort key with created_at and id as tie breakers, so a cursor
+// holding those values identifies a unique position in the list.
+func buildListQuery(opts listOptions, dialect sqlDialect) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions = append(conditions, ownerCondition(arg(opts.Owner)), notDeleted)
+
+	if opts.Done != nil {
+		conditions = append(conditions, "done = "+arg(*opts.Done))
+	}
+
+	if opts.Query != "" {
+		conditions = append(conditions, dialect.searchCondition(opts.Query, arg))
+	}
+
+	keys := []string{"created_at", "id"}
+	if opts.Sort == "priority" {
+		keys = []string{priorityRankSQL, "created_at", "id"}
+	}
+
+	if opts.Cursor != nil {
+		values := []string{arg(dialect.timeValue(opts.Cursor.CreatedAt)), arg(opts.Cursor.ID)}
+		if opts.Sort == "priority" {
+			values = append([]string{arg(opts.Cursor.Rank)}, values...)
+		}
+		comparison := "<"
+		if opts.Order == "asc" {
+			comparison = ">"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s) %s (%s)",
+			strings.Join(keys, ", "), comparison, strings.Join(values, ", ")))
+	}
+
+	query := "SELECT " + todoColumns + " FROM todos WHERE " + strings.Join(conditions, " AND ")
+
+	direction := " DESC"
+	if opts.Order == "asc" {
+		direction = " ASC"
+	}
+	query += " ORDER BY " + strings.Join(keys, direction+", ") + direction
+	query += " LIMIT " + arg(opts.Limit+1)
+
+	return query, args
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTodo reads a row selected with todoColumns into a Todo
+func scanTodo(row rowScanner) (Todo, error) {
+	var todo Todo
+	var createdAt time.Time
+	var completedAt sql.NullTime
+	var ownerID sql.NullInt64
+	var deletedAt sql.NullTime
+
+	err := row.Scan(&todo.ID, &todo.Text, &createdAt, &todo.Priority, &todo.Done, &completedAt,
+		&todo.Version, &ownerID, &deletedAt)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	todo.CreatedAt = createdAt
+	todo.Created = formatCreatedTime(createdAt)
+	if completedAt.Valid {
+		todo.CompletedAt = &completedAt.Time
+	}
+	todo.OwnerID = int(ownerID.Int64)
+	if deletedAt.Valid {
+		todo.DeletedAt = &deletedAt.Time
+	}
+	return todo, nil
+}
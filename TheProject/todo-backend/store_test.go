@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStores returns a memoryStore and a sqlStore on a fresh SQLite
+// database, for tests that hold for every TodoStore
+func testStores(t *testing.T) map[string]TodoStore {
+	t.Helper()
+
+	db, err := sql.Open(sqliteDialect.driver, sqliteDSN(filepath.Join(t.TempDir(), "todos.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrateSchema(db, sqliteDialect); err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]TodoStore{
+		"memory": newMemoryStore(),
+		"sqlite": newSQLStore(db, sqliteDialect),
+	}
+}
+
+func TestStoreState(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			seen := make(map[storeState]string)
+
+			// step runs a change and checks that it moved the list to a state
+			// it was never in before
+			step := func(name string, change func() error) {
+				t.Helper()
+				if err := change(); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				state, err := s.State(ctx, publicBoard)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if earlier, ok := seen[state]; ok {
+					t.Fatalf("%s: state %+v is the one after %s", name, state, earlier)
+				}
+				seen[state] = name
+			}
+
+			var first, second Todo
+			step("empty", func() error { return nil })
+			step("create", func() (err error) { first, err = s.Create(ctx, publicBoard, "First", "medium"); return })
+			step("create", func() (err error) { second, err = s.Create(ctx, publicBoard, "Second", "medium"); return })
+			step("create", func() error { _, err := s.Create(ctx, publicBoard, "Third", "medium"); return err })
+			step("update", func() error {
+				done := true
+				_, err := s.Update(ctx, publicBoard, first.ID, TodoUpdate{Done: &done})
+				return err
+			})
+			step("delete second", func() error { _, err := s.Delete(ctx, publicBoard, second.ID, nil); return err })
+			step("delete first", func() error { _, err := s.Delete(ctx, publicBoard, first.ID, nil); return err })
+			step("restore second", func() error { _, err := s.Restore(ctx, publicBoard, second.ID); return err })
+			step("import", func() error {
+				_, err := s.Import(ctx, publicBoard, []Todo{{Text: "Imported", Priority: "low", CreatedAt: time.Now().UTC()}})
+				return err
+			})
+
+			// Purging only empties the trash, which no list shows
+			before, _ := s.State(ctx, publicBoard)
+			if purged, err := s.PurgeTrash(ctx, time.Now().Add(time.Minute)); err != nil || purged != 1 {
+				t.Fatalf("purged %d, %v, want 1", purged, err)
+			}
+			if after, _ := s.State(ctx, publicBoard); after != before {
+				t.Fatalf("purge changed the state from %+v to %+v", before, after)
+			}
+
+			// Other lists are not affected
+			if state, _ := s.State(ctx, 42); state != (storeState{}) {
+				t.Fatalf("state of an untouched list = %+v", state)
+			}
+		})
+	}
+}
+
+// setCreatedAt backdates a todo, which no store method can do
+func setCreatedAt(t *testing.T, s TodoStore, id int, at time.Time) {
+	t.Helper()
+	switch s := s.(type) {
+	case *memoryStore:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		todo := s.todos[id]
+		todo.CreatedAt = at
+		s.todos[id] = todo
+	case *sqlStore:
+		if _, err := s.db.Exec("UPDATE todos SET created_at = $1 WHERE id = $2", s.dialect.timeValue(at), id); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("cannot backdate todos in %T", s)
+	}
+}
+
+// Walking every page with the cursor returns each matching todo exactly
+// once, in order, even when todos share their creation time
+func TestListPages(t *testing.T) {
+	seed := []struct {
+		text     string
+		priority string
+		done     bool
+	}{
+		{"Buy milk", "high", false},
+		{"Buy bread", "low", false},
+		{"Walk the dog", "medium", true},
+		{"Milk the cow", "medium", false},
+		{"Read a book", "high", true},
+		{"Buy more milk", "low", false},
+		{"Call mom", "medium", false},
+		{"Fix the bike", "high", false},
+		{"Water plants", "low", true},
+	}
+	yes, no := true, false
+
+	tests := []struct {
+		name string
+		opts listOptions
+	}{
+		{"newest first", listOptions{Sort: "created", Order: "desc"}},
+		{"oldest first", listOptions{Sort: "created", Order: "asc"}},
+		{"priority", listOptions{Sort: "priority", Order: "desc"}},
+		{"priority ascending", listOptions{Sort: "priority", Order: "asc"}},
+		{"search", listOptions{Sort: "created", Order: "desc", Query: "MILK"}},
+		{"search all terms", listOptions{Sort: "created", Order: "asc", Query: "buy milk"}},
+		{"done", listOptions{Sort: "created", Order: "desc", Done: &yes}},
+		{"open by priority", listOptions{Sort: "priority", Order: "desc", Done: &no}},
+	}
+
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			// Three todos share every creation time
+			base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			var todos []Todo
+			for i, seed := range seed {
+				todo, err := s.Create(ctx, publicBoard, seed.text, seed.priority)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seed.done {
+					if todo, err = s.Update(ctx, publicBoard, todo.ID, TodoUpdate{Done: &seed.done}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				todo.CreatedAt = base.Add(time.Duration(i/3) * time.Minute)
+				setCreatedAt(t, s, todo.ID, todo.CreatedAt)
+				todos = append(todos, todo)
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					want := expectedList(todos, tt.opts)
+					if len(want) < 2 {
+						t.Fatalf("only %d todos match, the walk proves nothing", len(want))
+					}
+
+					for _, limit := range []int{1, 2, 4, len(want), maxPageSize} {
+						opts := tt.opts
+						opts.Owner = publicBoard
+						opts.Limit = limit
+
+						var got []int
+						for page := 1; ; page++ {
+							todos, next, err := s.List(ctx, opts)
+							if err != nil {
+								t.Fatal(err)
+							}
+							if len(todos) > limit || (next != nil && len(todos) != limit) {
+								t.Fatalf("limit %d: page %d has %d todos, next %v", limit, page, len(todos), next)
+							}
+							for _, todo := range todos {
+								got = append(got, todo.ID)
+							}
+							if next == nil {
+								break
+							}
+							if page > len(want) {
+								t.Fatalf("limit %d: still paging after %d pages", limit, page)
+							}
+							opts.Cursor = next
+						}
+
+						if !slices.Equal(got, want) {
+							t.Fatalf("limit %d: walked %v, want %v", limit, got, want)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// expectedList filters and orders todos the way opts asks for, returning
+// their IDs
+func expectedList(todos []Todo, opts listOptions) []int {
+	var matches []Todo
+	for _, todo := range todos {
+		if opts.Done != nil && todo.Done != *opts.Done {
+			continue
+		}
+		if !containsAllTerms(todo.Text, strings.Fields(strings.ToLower(opts.Query))) {
+			continue
+		}
+		matches = append(matches, todo)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		before := a.ID < b.ID
+		switch {
+		case opts.Sort == "priority" && a.Priority != b.Priority:
+			before = priorityRank(a.Priority) < priorityRank(b.Priority)
+		case !a.CreatedAt.Equal(b.CreatedAt):
+			before = a.CreatedAt.Before(b.CreatedAt)
+		}
+		if opts.Order == "desc" {
+			return !before
+		}
+		return before
+	})
+
+	ids := make([]int, 0, len(matches))
+	for _, todo := range matches {
+		ids = append(ids, todo.ID)
+	}
+	return ids
+}
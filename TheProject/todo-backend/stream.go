@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamSubscriberBuffer is how many events may queue up for a slow client
+// before it is disconnected. It reconnects with Last-Event-ID and catches up
+// from the hub's buffer.
+const streamSubscriberBuffer = 64
+
+// streamEvent is one todo change sent to GET /todos/stream clients
+type streamEvent struct {
+	Seq uint64
+	// Owner is whose list the todo is on; only that owner's clients get it
+	Owner int
+	Type  string
+	Data  []byte
+}
+
+// streamHub fans todo changes out to every connected stream client and keeps
+// the most recent ones in a ring buffer, so reconnecting clients can resume
+// where they left off. It implements EventPublisher.
+type streamHub struct {
+	mu sync.Mutex
+	// epoch identifies this process in event IDs; IDs issued by another
+	// replica or before a restart cannot be resumed from
+	epoch   string
+	lastSeq uint64
+	// ring holds the last len(ring) events, the oldest at ring[start]
+	ring  []streamEvent
+	start int
+	count int
+	// subscribers maps each client to the owner whose list it follows
+	subscribers map[chan streamEvent]int
+	closed      bool
+	// keepalive is how often idle streams get a comment, see STREAM_KEEPALIVE
+	keepalive time.Duration
+}
+
+func newStreamHub(bufferSize int, keepalive time.Duration) *streamHub {
+	return &streamHub{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		ring:        make([]streamEvent, bufferSize),
+		subscribers: make(map[chan streamEvent]int),
+		keepalive:   keepalive,
+	}
+}
+
+// todoStream serves GET /todos/stream, see newStreamHub
+var todoStream *streamHub
+
+// Publish sends a todo change to every subscriber
+func (h *streamHub) Publish(ctx context.Context, eventType string, todo Todo) error {
+	data, err := json.Marshal(todo)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+
+	h.lastSeq++
+	event := streamEvent{Seq: h.lastSeq, Owner: todo.OwnerID, Type: eventType, Data: data}
+
+	if len(h.ring) > 0 {
+		if h.count < len(h.ring) {
+			h.ring[(h.start+h.count)%len(h.ring)] = event
+			h.count++
+		} else {
+			h.ring[h.start] = event
+			h.start = (h.start + 1) % len(h.ring)
+		}
+	}
+
+	for ch, owner := range h.subscribers {
+		if owner != event.Owner {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			// Too slow to keep up, drop it and let it resume
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a client following the list of owner. lastEventID is
+// the Last-Event-ID the client sent, if any. It returns the buffered events the client missed, and
+// resumed is false when the client's position could not be found, so it has
+// to reload the list. position is the ID of the latest event so far.
+func (h *streamHub) Subscribe(owner int, lastEventID string) (ch chan streamEvent, missed []streamEvent, resumed bool, position string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	position = h.eventID(h.lastSeq)
+	ch = make(chan streamEvent, streamSubscriberBuffer)
+	if h.closed {
+		close(ch)
+		return ch, nil, false, position
+	}
+	h.subscribers[ch] = owner
+
+	if lastEventID == "" {
+		return ch, nil, true, position
+	}
+
+	epoch, seqText, ok := strings.Cut(lastEventID, "-")
+	seq, err := strconv.ParseUint(seqText, 10, 64)
+	if !ok || err != nil || epoch != h.epoch || seq > h.lastSeq {
+		return ch, nil, false, position
+	}
+
+	// Everything after seq has to still be buffered
+	oldest := h.lastSeq - uint64(h.count) + 1
+	if seq+1 < oldest {
+		return ch, nil, false, position
+	}
+	for i := 0; i < h.count; i++ {
+		event := h.ring[(h.start+i)%len(h.ring)]
+		if event.Seq > seq && event.Owner == owner {
+			missed = append(missed, event)
+		}
+	}
+	return ch, missed, true, position
+}
+
+// Unsubscribe removes a client that disconnected
+func (h *streamHub) Unsubscribe(ch chan streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Close ends every open stream. It runs when the server starts shutting
+// down, since open streams would otherwise hold up the drain.
+func (h *streamHub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+	return nil
+}
+
+// eventID is the SSE id of an event, see streamHub.epoch
+func (h *streamHub) eventID(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// GET /todos/stream - Server-Sent Events of todo changes. Each event is named
+// after the change (todo.created, todo.updated, todo.deleted, todo.restored)
+// and carries the todo's JSON. A reconnecting client sends Last-Event-ID and
+// receives what it missed; when that is no longer possible it gets a reset
+// event and should reload the list.
+func streamTodos(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	events, missed, resumed, position := todoStream.Subscribe(ownerFromContext(r.Context()), lastEventID)
+	defer todoStream.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Keeps nginx based ingresses from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Ask browsers to reconnect quickly after the stream ends
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if lastEventID != "" && !resumed {
+		// The id moves the client to the current position, so its next
+		// reconnect can resume again
+		fmt.Fprintf(w, "id: %s\nevent: reset\ndata: {}\n\n", position)
+	}
+	for _, event := range missed {
+		writeStreamEvent(w, event)
+	}
+	if err := rc.Flush(); err != nil {
+		logger.Error("ERROR", "event", "stream_flush_failed", "error", err)
+		return
+	}
+
+	logger.Info("STREAM", "event", "subscribed", "last_event_id", lastEventID,
+		"resumed", resumed, "replayed", len(missed))
+
+	keepalive := time.NewTicker(todoStream.keepalive)
+	defer keepalive.Stop()
+
+	sent := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.Info("STREAM", "event", "client_disconnected", "sent", sent)
+			return
+		case event, ok := <-events:
+			if !ok {
+				logger.Info("STREAM", "event", "closed_by_server", "sent", sent)
+				return
+			}
+			writeStreamEvent(w, event)
+			sent++
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+
+		if err := rc.Flush(); err != nil {
+			logger.Info("STREAM", "event", "write_failed", "sent", sent, "error", err)
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes one event in the text/event-stream format. The
+// JSON payload never contains a newline, so it fits on a single data line.
+func writeStreamEvent(w http.ResponseWriter, event streamEvent) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", todoStream.eventID(event.Seq), event.Type, event.Data)
+}
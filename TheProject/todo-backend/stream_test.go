@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamTodos(t *testing.T) {
+	api := newTestAPI(t)
+
+	oldStream := todoStream
+	t.Cleanup(func() { todoStream = oldStream })
+	todoStream = newStreamHub(16, 50*time.Millisecond)
+	events = todoStream
+
+	server := httptest.NewServer(api.mux)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/todos/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	readUntil := func(prefix string) string {
+		t.Helper()
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), prefix) {
+				return lines.Text()
+			}
+		}
+		t.Fatalf("stream ended before %q: %v", prefix, lines.Err())
+		return ""
+	}
+	// Idle streams get keepalive comments
+	readUntil(": keepalive")
+
+	todo := api.createTodo("Streamed")
+	if line := readUntil("event: "); line != "event: "+eventTodoCreated {
+		t.Fatalf("got %q, want event: %s", line, eventTodoCreated)
+	}
+	if line := readUntil("data: "); !strings.Contains(line, `"text":"Streamed"`) || !strings.Contains(line, `"version":1`) {
+		t.Fatalf("data of todo %d = %q", todo.ID, line)
+	}
+}
+
+func TestStreamKeepaliveMustBePositive(t *testing.T) {
+	t.Setenv("STREAM_KEEPALIVE", "0")
+	if _, err := intervalFromEnv("STREAM_KEEPALIVE", 15*time.Second); err == nil {
+		t.Fatal("STREAM_KEEPALIVE=0 accepted")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// trashPurger permanently removes todos that have been in the trash longer
+// than the retention period. Every replica runs one; purging the same rows
+// twice is harmless.
+type trashPurger struct {
+	store     TodoStore
+	retention time.Duration
+	interval  time.Duration
+}
+
+// newTrashPurgerFromEnv configures the purger from TRASH_RETENTION and
+// TRASH_PURGE_INTERVAL. A retention of 0 keeps deleted todos forever and
+// returns nil.
+func newTrashPurgerFromEnv(store TodoStore) (*trashPurger, error) {
+	retention := durationFromEnv("TRASH_RETENTION", 30*24*time.Hour)
+	if retention == 0 {
+		slog.Info("Trash purging disabled, deleted todos are kept")
+		return nil, nil
+	}
+	interval, err := intervalFromEnv("TRASH_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return &trashPurger{store: store, retention: retention, interval: interval}, nil
+}
+
+// Run purges the trash every interval until ctx is cancelled
+func (p *trashPurger) Run(ctx context.Context) {
+	slog.Info("Trash purger started", "retention", p.retention.String(), "interval", p.interval.String())
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.purge(ctx)
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Trash purger stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge removes todos deleted longer ago than the retention period
+func (p *trashPurger) purge(ctx context.Context) {
+	purged, err := p.store.PurgeTrash(ctx, time.Now().UTC().Add(-p.retention))
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("ERROR", "event", "trash_purge_failed", "error", err)
+		}
+		return
+	}
+	if purged > 0 {
+		todosPurgedTotal.Add(float64(purged))
+		slog.Info("TRASH", "event", "purged", "count", purged)
+	}
+}
+
+// GET /todos/trash - Deleted todos on the caller's list, most recently
+// deleted first
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	todos, err := store.Trash(r.Context(), ownerFromContext(r.Context()))
+	if err != nil {
+		logger.Error("ERROR", "event", "database_query_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	// Always encode a JSON array, never null
+	if todos == nil {
+		todos = []Todo{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(todos)
+
+	logger.Info("SUCCESS", "event", "trash_retrieved", "count", len(todos))
+}
+
+// POST /todos/{id}/restore - Take a todo out of the trash
+func restoreTodo(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	id, err := parseTodoID(r)
+	if err != nil {
+		logger.Warn("REJECT", "reason", "invalid_id", "id", r.PathValue("id"))
+		writeProblem(w, r, &apiError{Code: codeInvalidID, Detail: "Invalid todo ID"})
+		return
+	}
+
+	todo, err := store.Restore(r.Context(), ownerFromContext(r.Context()), id)
+	if errors.Is(err, errTodoNotFound) {
+		logger.Warn("REJECT", "reason", "todo_not_found", "id", id)
+		writeProblem(w, r, &apiError{Code: codeTodoNotFound, Detail: "Todo not found in the trash"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "database_update_failed", "id", id, "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(todo)
+	publishEvent(r.Context(), eventTodoRestored, todo)
+
+	logger.Info("SUCCESS", "event", "todo_restored", "id", todo.ID)
+}
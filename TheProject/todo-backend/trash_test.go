@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	api := newTestAPI(t)
+	todo := api.createTodo("Take me out")
+	path := "/todos/" + strconv.Itoa(todo.ID)
+
+	if rec := api.do("DELETE", path, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+	expectProblem(t, api.do("GET", path, ""), http.StatusNotFound, codeTodoNotFound)
+
+	var trash []Todo
+	decodeBody(t, api.do("GET", "/todos/trash", ""), &trash)
+	if len(trash) != 1 || trash[0].ID != todo.ID || trash[0].DeletedAt == nil {
+		t.Fatalf("trash = %+v", trash)
+	}
+
+	rec := api.do("POST", path+"/restore", "")
+	var restored Todo
+	decodeBody(t, rec, &restored)
+	if rec.Code != http.StatusOK || restored.DeletedAt != nil || restored.Version != todo.Version+1 {
+		t.Fatalf("restore: status %d: %s", rec.Code, rec.Body)
+	}
+	decodeBody(t, api.do("GET", "/todos/trash", ""), &trash)
+	if len(trash) != 0 {
+		t.Fatalf("trash after restore = %+v", trash)
+	}
+
+	expectProblem(t, api.do("POST", path+"/restore", ""), http.StatusNotFound, codeTodoNotFound)
+	expectProblem(t, api.do("POST", "/todos/42/restore", ""), http.StatusNotFound, codeTodoNotFound)
+	expectProblem(t, api.do("POST", "/todos/abc/restore", ""), http.StatusBadRequest, codeInvalidID)
+
+	// Other lists' trash is out of reach
+	api.do("DELETE", path, "")
+	alice := api.signup("alice")
+	expectProblem(t, api.do("POST", path+"/restore", "", "Authorization", alice), http.StatusNotFound, codeTodoNotFound)
+}
+
+// Deleting one todo and restoring another used to leave the list with the
+// same count, highest ID and version sum, and so the same ETag
+func TestRestoreChangesListETag(t *testing.T) {
+	api := newTestAPI(t)
+	first := api.createTodo("First")
+	second := api.createTodo("Second")
+	api.createTodo("Third")
+
+	steps := func(steps ...[2]string) {
+		t.Helper()
+		for _, step := range steps {
+			if rec := api.do(step[0], step[1], ""); rec.Code >= 300 {
+				t.Fatalf("%s %s: status %d: %s", step[0], step[1], rec.Code, rec.Body)
+			}
+		}
+	}
+
+	// Third at version 1 and First at version 2 are left
+	steps([2]string{"PUT", "/todos/" + strconv.Itoa(first.ID) + "/done"},
+		[2]string{"DELETE", "/todos/" + strconv.Itoa(second.ID)})
+	etag := api.do("GET", "/todos", "").Header().Get("ETag")
+
+	// Third at version 1 and Second at version 2 are left
+	steps([2]string{"DELETE", "/todos/" + strconv.Itoa(first.ID)},
+		[2]string{"POST", "/todos/" + strconv.Itoa(second.ID) + "/restore"})
+
+	rec := api.do("GET", "/todos", "", "If-None-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list after delete and restore: status %d, want 200", rec.Code)
+	}
+	var todos []Todo
+	decodeBody(t, rec, &todos)
+	if len(todos) != 2 || todos[1].ID != second.ID {
+		t.Fatalf("list = %+v, want Third and Second", todos)
+	}
+}
+
+// recordingPublisher keeps the type of every event published
+type recordingPublisher struct {
+	types []string
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, eventType string, todo Todo) error {
+	p.types = append(p.types, eventType)
+	return nil
+}
+
+func (p *recordingPublisher) Close() error {
+	return nil
+}
+
+// A restore is its own event, so webhooks do not announce it as a new todo
+func TestRestorePublishesRestored(t *testing.T) {
+	api := newTestAPI(t)
+	published := &recordingPublisher{}
+	events = published
+
+	todo := api.createTodo("Back again")
+	path := "/todos/" + strconv.Itoa(todo.ID)
+	api.do("DELETE", path, "")
+	if rec := api.do("POST", path+"/restore", ""); rec.Code != http.StatusOK {
+		t.Fatalf("restore: status %d: %s", rec.Code, rec.Body)
+	}
+
+	want := []string{eventTodoCreated, eventTodoDeleted, eventTodoRestored}
+	if len(published.types) != len(want) {
+		t.Fatalf("published %v, want %v", published.types, want)
+	}
+	for i := range want {
+		if published.types[i] != want[i] {
+			t.Fatalf("published %v, want %v", published.types, want)
+		}
+	}
+}
+
+func TestTrashPurgerFromEnv(t *testing.T) {
+	t.Setenv("TRASH_RETENTION", "")
+	t.Setenv("TRASH_PURGE_INTERVAL", "")
+	purger, err := newTrashPurgerFromEnv(newMemoryStore())
+	if err != nil || purger.interval != time.Hour || purger.retention != 30*24*time.Hour {
+		t.Fatalf("defaults: %+v, %v", purger, err)
+	}
+
+	for _, value := range []string{"0", "-1h", "hourly"} {
+		t.Setenv("TRASH_PURGE_INTERVAL", value)
+		if _, err := newTrashPurgerFromEnv(newMemoryStore()); err == nil {
+			t.Errorf("TRASH_PURGE_INTERVAL=%q: no error", value)
+		}
+	}
+
+	// Without retention there is nothing to purge, whatever the interval
+	t.Setenv("TRASH_RETENTION", "0")
+	if purger, err := newTrashPurgerFromEnv(newMemoryStore()); purger != nil || err != nil {
+		t.Fatalf("TRASH_RETENTION=0: %+v, %v", purger, err)
+	}
+}
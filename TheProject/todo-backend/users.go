@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// publicBoard is the owner of todos created without logging in, see
+// PUBLIC_BOARD
+const publicBoard = 0
+
+const (
+	minPasswordLength = 8
+	// bcrypt only looks at the first 72 bytes
+	maxPasswordLength = 72
+)
+
+var (
+	// errUsernameTaken is returned by a TodoStore when a username is in use
+	errUsernameTaken = errors.New("username taken")
+	// errUserNotFound is returned by a TodoStore when no user has the name
+	errUserNotFound = errors.New("user not found")
+	// errSessionNotFound is returned by a TodoStore for unknown or expired
+	// session tokens
+	errSessionNotFound = errors.New("session not found")
+)
+
+// usernamePattern restricts usernames to what is safe to show and log
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,31}$`)
+
+// User is an account that owns a todo list
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Session is a login. Only the SHA-256 hash of its token is stored, so a
+// leaked database does not hand out working tokens.
+type Session struct {
+	TokenHash string
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// CredentialsRequest is the body of POST /auth/signup and POST /auth/login
+type CredentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SessionResponse is returned by signup and login. The token goes into an
+// Authorization: Bearer header on later requests.
+type SessionResponse struct {
+	User      User      `json:"user"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// dummyPasswordHash is compared against when a login names an unknown user,
+// so the response time does not tell which usernames exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// publicBoardEnabled reports whether requests without a session or API key
+// may read the shared public board. It is meant for the course demo, where
+// visitors of the frontend do not log in. PUBLIC_BOARD=true also lets them
+// change it, PUBLIC_BOARD=read only lets them look.
+func publicBoardEnabled() bool {
+	access := os.Getenv("PUBLIC_BOARD")
+	return access == "true" || access == "read"
+}
+
+// publicBoardWritable reports whether anonymous requests may change the
+// public board, see publicBoardEnabled
+func publicBoardWritable() bool {
+	return os.Getenv("PUBLIC_BOARD") == "true"
+}
+
+// userFromContext returns the logged in user of a request, if any
+func userFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey).(User)
+	return user, ok
+}
+
+// ownerFromContext returns whose todo list a request works on: the logged
+// in user's, the one of its API key, or the public board
+func ownerFromContext(ctx context.Context) int {
+	if user, ok := userFromContext(ctx); ok {
+		return user.ID
+	}
+	if key, ok := apiKeyFromContext(ctx); ok {
+		return key.OwnerID
+	}
+	return publicBoard
+}
+
+// authenticate resolves the session token or API key sent with a request
+// and puts the user or key into the request context. Requests without either
+// are let through to the public board as far as PUBLIC_BOARD allows, and
+// rejected with 401 otherwise.
+func authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFromContext(r.Context())
+
+		// CORS preflights never carry credentials
+		if r.Method == "OPTIONS" {
+			handler(w, r)
+			return
+		}
+
+		token := bearerToken(r)
+		if token == "" {
+			if publicBoardEnabled() && hasScope(r.Context(), requiredScope(r)) {
+				handler(w, r)
+				return
+			}
+			logger.Warn("REJECT", "reason", "unauthenticated", "path", r.URL.Path)
+			enableCORS(w)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="todo-backend"`)
+			writeProblem(w, r, &apiError{Code: codeUnauthenticated, Detail: "Authentication required"})
+			return
+		}
+
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			authenticateAPIKey(w, r, token, handler)
+			return
+		}
+
+		user, err := store.GetSessionUser(r.Context(), hashToken(token))
+		if errors.Is(err, errSessionNotFound) {
+			logger.Warn("REJECT", "reason", "invalid_session", "path", r.URL.Path)
+			enableCORS(w)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="todo-backend", error="invalid_token"`)
+			writeProblem(w, r, &apiError{Code: codeInvalidSession, Detail: "Invalid or expired session"})
+			return
+		}
+		if err != nil {
+			logger.Error("ERROR", "event", "session_lookup_failed", "error", err)
+			enableCORS(w)
+			writeProblem(w, r, errInternal)
+			return
+		}
+
+		logger = logger.With("user_id", user.ID)
+		ctx := context.WithValue(r.Context(), loggerKey, logger)
+		ctx = context.WithValue(ctx, userKey, user)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// bearerToken reads the token from the Authorization header, or from the
+// access_token query parameter for browser APIs that cannot set headers,
+// such as EventSource and WebSocket
+func bearerToken(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// newToken returns a random session token
+func newToken() string {
+	var b [32]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// hashToken is how tokens are looked up in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateCredentials checks a signup request. On failure it returns the
+// reason used in log lines, the message sent to the client and the field at
+// fault.
+func validateCredentials(req CredentialsRequest) (reason, message, field string) {
+	if !usernamePattern.MatchString(req.Username) {
+		return "invalid_username", "Username must be 3 to 32 characters of a-z, 0-9, '_', '.' or '-', starting with a letter or digit", "/username"
+	}
+	if len(req.Password) < minPasswordLength {
+		return "password_too_short", "Password must be at least 8 characters", "/password"
+	}
+	if len(req.Password) > maxPasswordLength {
+		return "password_too_long", "Password must be at most 72 bytes", "/password"
+	}
+	return "", "", ""
+}
+
+// POST /auth/signup - Create an account and log in
+func signup(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	var req CredentialsRequest
+	if reason := decodeRequest(w, r, "CredentialsRequest", &req); reason != "" {
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+
+	if reason, message, field := validateCredentials(req); reason != "" {
+		logger.Warn("REJECT", "reason", reason, "username", req.Username)
+		writeProblem(w, r, &apiError{Code: codeFromReason(reason), Detail: message, Field: field})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		logger.Error("ERROR", "event", "password_hash_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	user, err := store.CreateUser(r.Context(), req.Username, string(hash))
+	if errors.Is(err, errUsernameTaken) {
+		logger.Warn("REJECT", "reason", "username_taken", "username", req.Username)
+		writeProblem(w, r, &apiError{Code: codeUsernameTaken, Detail: "Username is already taken", Field: "/username"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "database_insert_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	logger.Info("SUCCESS", "event", "user_created", "user_id", user.ID, "username", user.Username)
+	startSession(w, r, user, http.StatusCreated)
+}
+
+// POST /auth/login - Exchange a username and password for a session token
+func login(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	var req CredentialsRequest
+	if reason := decodeRequest(w, r, "CredentialsRequest", &req); reason != "" {
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+
+	user, hash, err := store.GetUserByName(r.Context(), req.Username)
+	if errors.Is(err, errUserNotFound) {
+		// Take as long as a wrong password would
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		logger.Warn("REJECT", "reason", "invalid_credentials", "username", req.Username)
+		writeProblem(w, r, &apiError{Code: codeInvalidCredentials, Detail: "Invalid username or password"})
+		return
+	}
+	if err != nil {
+		logger.Error("ERROR", "event", "database_query_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		logger.Warn("REJECT", "reason", "invalid_credentials", "username", req.Username)
+		writeProblem(w, r, &apiError{Code: codeInvalidCredentials, Detail: "Invalid username or password"})
+		return
+	}
+
+	logger.Info("SUCCESS", "event", "user_logged_in", "user_id", user.ID)
+	startSession(w, r, user, http.StatusOK)
+}
+
+// startSession creates a session for user and sends its token
+func startSession(w http.ResponseWriter, r *http.Request, user User, status int) {
+	logger := loggerFromContext(r.Context())
+
+	token := newToken()
+	now := time.Now().UTC()
+	session := Session{
+		TokenHash: hashToken(token),
+		UserID:    user.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(durationFromEnv("SESSION_TTL", 30*24*time.Hour)),
+	}
+
+	if err := store.CreateSession(r.Context(), session); err != nil {
+		logger.Error("ERROR", "event", "database_insert_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(SessionResponse{User: user, Token: token, ExpiresAt: session.ExpiresAt})
+}
+
+// POST /auth/logout - End the session the request was made with
+func logout(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		logger.Warn("REJECT", "reason", "unauthenticated", "path", r.URL.Path)
+		writeProblem(w, r, &apiError{Code: codeUnauthenticated, Detail: "Authentication required"})
+		return
+	}
+
+	if err := store.DeleteSession(r.Context(), hashToken(bearerToken(r))); err != nil {
+		logger.Error("ERROR", "event", "database_delete_failed", "error", err)
+		writeProblem(w, r, errInternal)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("SUCCESS", "event", "user_logged_out", "user_id", user.ID)
+}
+
+// GET /auth/me - The user the request was made as
+func currentUser(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	enableCORS(w)
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		logger.Warn("REJECT", "reason", "unauthenticated", "path", r.URL.Path)
+		writeProblem(w, r, &apiError{Code: codeUnauthenticated, Detail: "Authentication required"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
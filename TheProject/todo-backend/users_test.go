@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestSignupAndLogin(t *testing.T) {
+	api := newTestAPI(t)
+	auth := api.signup("alice")
+
+	rec := api.do("GET", "/auth/me", "", "Authorization", auth)
+	var user User
+	decodeBody(t, rec, &user)
+	if rec.Code != http.StatusOK || user.Username != "alice" {
+		t.Fatalf("me: status %d: %s", rec.Code, rec.Body)
+	}
+
+	expectProblem(t, api.do("POST", "/auth/signup", `{"username":"alice","password":"password2"}`),
+		http.StatusConflict, codeUsernameTaken)
+	expectProblem(t, api.do("POST", "/auth/signup", `{"username":"bob","password":"short"}`),
+		http.StatusBadRequest, codePasswordTooShort)
+	expectProblem(t, api.do("POST", "/auth/login", `{"username":"alice","password":"wrong-password"}`),
+		http.StatusUnauthorized, codeInvalidCredentials)
+
+	rec = api.do("POST", "/auth/login", `{"username":"Alice","password":"password1"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := api.do("POST", "/auth/logout", "", "Authorization", auth); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: status %d: %s", rec.Code, rec.Body)
+	}
+	expectProblem(t, api.do("GET", "/auth/me", "", "Authorization", auth), http.StatusUnauthorized, codeInvalidSession)
+}
+
+func TestTodoListsArePrivate(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.signup("alice")
+	bob := api.signup("bob")
+
+	todo := api.createTodo("Alice's", "Authorization", alice)
+	path := "/todos/" + strconv.Itoa(todo.ID)
+
+	var todos []Todo
+	decodeBody(t, api.do("GET", "/todos", "", "Authorization", bob), &todos)
+	if len(todos) != 0 {
+		t.Fatalf("bob sees %+v", todos)
+	}
+	decodeBody(t, api.do("GET", "/todos", ""), &todos)
+	if len(todos) != 0 {
+		t.Fatalf("the public board shows %+v", todos)
+	}
+
+	// Another user's todo does not exist as far as bob is concerned
+	expectProblem(t, api.do("GET", path, "", "Authorization", bob), http.StatusNotFound, codeTodoNotFound)
+	expectProblem(t, api.do("PATCH", path, `{"text":"Bob's"}`, "Authorization", bob), http.StatusNotFound, codeTodoNotFound)
+	expectProblem(t, api.do("DELETE", path, "", "Authorization", bob), http.StatusNotFound, codeTodoNotFound)
+
+	if rec := api.do("GET", path, "", "Authorization", alice); rec.Code != http.StatusOK {
+		t.Fatalf("alice: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAuthenticationRequired(t *testing.T) {
+	api := newTestAPI(t)
+	t.Setenv("PUBLIC_BOARD", "")
+
+	expectProblem(t, api.do("GET", "/todos", ""), http.StatusUnauthorized, codeUnauthenticated)
+	expectProblem(t, api.do("GET", "/todos", "", "Authorization", "Bearer nope"), http.StatusUnauthorized, codeInvalidSession)
+}
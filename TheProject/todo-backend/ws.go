@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsMaxMessageSize bounds a single client message
+	wsMaxMessageSize = 8192
+	// wsPingInterval is how often clients are pinged; a client that has not
+	// answered within wsPongTimeout is disconnected
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 75 * time.Second
+	// wsWriteTimeout bounds writing one message to a client
+	wsWriteTimeout = 10 * time.Second
+	// wsRequestTimeout bounds the store call behind one client message
+	wsRequestTimeout = 10 * time.Second
+)
+
+// wsRequest is a message sent by a WebSocket client. Type is one of
+// subscribe, create, update or delete; the other fields depend on it.
+type wsRequest struct {
+	Type string `json:"type"`
+	// Ref is copied into the reply, so clients can match replies to requests
+	Ref string `json:"ref,omitempty"`
+
+	// ID and Version name the todo an update or delete applies to. The change
+	// is rejected when the todo is no longer at Version.
+	ID      int  `json:"id,omitempty"`
+	Version *int `json:"version,omitempty"`
+
+	Text     *string `json:"text,omitempty"`
+	Priority *string `json:"priority,omitempty"`
+	Done     *bool   `json:"done,omitempty"`
+
+	// LastEventID resumes a subscription after the given event, as the
+	// Last-Event-ID header does for GET /todos/stream
+	LastEventID string `json:"last_event_id,omitempty"`
+}
+
+// wsMessage is a message sent to a WebSocket client: an ack or error reply
+// to a request, a todo change event, or a reset after missed events
+type wsMessage struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"`
+
+	// Version is the todo's version after the acknowledged change
+	Version int `json:"version,omitempty"`
+
+	// Event and EventID describe a todo change, EventID doubles as the
+	// position to resume a subscription from
+	Event   string `json:"event,omitempty"`
+	EventID string `json:"event_id,omitempty"`
+
+	Todo json.RawMessage `json:"todo,omitempty"`
+
+	Error   errorCode `json:"error,omitempty"`
+	Rule    string    `json:"rule,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// wsError is a request that failed, sent back as an error message
+type wsError struct {
+	code    errorCode
+	message string
+	rule    string
+	// todo is the current state of the todo for version conflicts
+	todo *Todo
+}
+
+// wsUpgrader accepts WebSocket connections from the origins listed in
+// WS_ALLOWED_ORIGINS, see checkWebSocketOrigin
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: checkWebSocketOrigin,
+}
+
+// Upgraded connections are not tracked by http.Server, so they are closed
+// through wsClosing and waited for through wsActive instead
+var (
+	wsClosing      = make(chan struct{})
+	closeWSClosing sync.Once
+	wsActive       sync.WaitGroup
+)
+
+// closeWebSockets ends every WebSocket connection
+func closeWebSockets() {
+	closeWSClosing.Do(func() { close(wsClosing) })
+}
+
+// waitWebSockets closes every WebSocket connection and waits for their
+// handlers to finish. Call it after http.Server.Shutdown, which counts
+// requests that have not been upgraded yet among the in-flight ones.
+func waitWebSockets() {
+	closeWebSockets()
+	wsActive.Wait()
+}
+
+// checkWebSocketOrigin accepts connections without an Origin header (not
+// from a browser), from the same host, and from the comma separated origins
+// in WS_ALLOWED_ORIGINS, where * allows every origin
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || (allowed != "" && strings.EqualFold(allowed, origin)) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// wsClient is one WebSocket connection
+type wsClient struct {
+	conn   *websocket.Conn
+	ctx    context.Context
+	logger *slog.Logger
+	// owner is whose todo list the connection works on, see authenticate
+	owner int
+	// rateKey and rateKind identify the client to createLimiter, see
+	// rateLimitKey
+	rateKey, rateKind string
+
+	// writeMu serializes writes, which come from the read loop and the
+	// subscription
+	writeMu sync.Mutex
+
+	// done is closed once the connection is finished
+	done       chan struct{}
+	subscribed bool
+}
+
+// GET /ws - WebSocket API for editing todos collaboratively. Clients send
+// JSON requests (subscribe, create, update, delete) and get an ack carrying
+// the todo's new version, or an error. Updates and deletes must name the
+// version they are based on and are rejected with VERSION_CONFLICT when
+// someone else changed the todo in the meantime. After subscribe, every
+// todo change is pushed as an event message.
+func serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+
+	wsActive.Add(1)
+	defer wsActive.Done()
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		logger.Warn("REJECT", "reason", "websocket_upgrade_failed", "origin", r.Header.Get("Origin"),
+			"error", err)
+		return
+	}
+	defer conn.Close()
+
+	client := &wsClient{
+		conn:   conn,
+		ctx:    r.Context(),
+		logger: logger,
+		owner:  ownerFromContext(r.Context()),
+		done:   make(chan struct{}),
+	}
+	client.rateKey, client.rateKind = rateLimitKey(r)
+	defer close(client.done)
+
+	websocketConnections.Inc()
+	defer websocketConnections.Dec()
+	logger.Info("WS", "event", "connected")
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	go client.keepalive()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			logger.Info("WS", "event", "disconnected", "reason", err.Error())
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger.Warn("REJECT", "reason", "invalid_json", "error", err)
+			client.sendError("", &wsError{code: codeInvalidJSON, message: "Invalid JSON"})
+			continue
+		}
+		client.handle(req)
+	}
+}
+
+// keepalive pings the client until the connection is done, and closes it
+// when the server shuts down
+func (c *wsClient) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-wsClosing:
+			c.close(websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// handle answers one client request
+func (c *wsClient) handle(req wsRequest) {
+	if req.Type == "subscribe" {
+		c.subscribe(req)
+		return
+	}
+
+	// Read-only API keys and anonymous visitors of a read-only public board
+	// may follow changes but not make them
+	isChange := req.Type == "create" || req.Type == "update" || req.Type == "delete"
+	if isChange && !hasScope(c.ctx, scopeWrite) {
+		c.logger.Warn("REJECT", "reason", "insufficient_scope", "scope", scopeWrite, "type", req.Type)
+		c.sendError(req.Ref, &wsError{code: codeInsufficientScope, message: "Not allowed to change todos"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, wsRequestTimeout)
+	defer cancel()
+
+	var todo Todo
+	var wsErr *wsError
+	switch req.Type {
+	case "create":
+		todo, wsErr = c.create(ctx, req)
+	case "update":
+		todo, wsErr = c.update(ctx, req)
+	case "delete":
+		todo, wsErr = c.delete(ctx, req)
+	default:
+		c.logger.Warn("REJECT", "reason", "invalid_message", "type", req.Type)
+		wsErr = &wsError{code: codeInvalidRequest, message: "Unknown message type " + req.Type}
+	}
+
+	if wsErr != nil {
+		c.sendError(req.Ref, wsErr)
+		return
+	}
+
+	data, _ := json.Marshal(todo)
+	c.send(wsMessage{Type: "ack", Ref: req.Ref, Version: todo.Version, Todo: data})
+}
+
+func (c *wsClient) create(ctx context.Context, req wsRequest) (Todo, *wsError) {
+	text := ""
+	if req.Text != nil {
+		text = *req.Text
+	}
+	priority := ""
+	if req.Priority != nil {
+		priority = *req.Priority
+	}
+
+	if wsErr := c.checkText(text, 0); wsErr != nil {
+		return Todo{}, wsErr
+	}
+
+	// Creating over the WebSocket counts against the same limit as POST /todos
+	if createLimiter != nil {
+		if ok, wait := createLimiter.Allow(c.rateKey); !ok {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			rateLimitedTotal.WithLabelValues(c.rateKind).Inc()
+			c.logger.Warn("REJECT", "reason", "rate_limited", "client", c.rateKey, "retry_after_seconds", retryAfter)
+			return Todo{}, &wsError{code: codeRateLimited,
+				message: fmt.Sprintf("Too many todos, retry in %d seconds", retryAfter)}
+		}
+	}
+
+	todo, err := store.Create(ctx, c.owner, text, normalizePriority(c.logger, priority))
+	if err != nil {
+		c.logger.Error("ERROR", "event", "database_insert_failed", "error", err)
+		return Todo{}, &wsError{code: codeInternal, message: "Internal server error"}
+	}
+
+	todosCreatedTotal.Inc()
+	publishEvent(ctx, eventTodoCreated, todo)
+
+	c.logger.Info("SUCCESS", "event", "todo_created", "via", "websocket", "id", todo.ID,
+		"text_length", len(todo.Text), "priority", todo.Priority, "text", textPreview(todo.Text))
+	return todo, nil
+}
+
+func (c *wsClient) update(ctx context.Context, req wsRequest) (Todo, *wsError) {
+	if wsErr := c.checkTarget(req); wsErr != nil {
+		return Todo{}, wsErr
+	}
+
+	if req.Text == nil && req.Priority == nil && req.Done == nil {
+		c.logger.Warn("REJECT", "reason", "empty_update", "id", req.ID)
+		return Todo{}, &wsError{code: codeInvalidRequest, message: "Nothing to update"}
+	}
+
+	if req.Text != nil {
+		if wsErr := c.checkText(*req.Text, req.ID); wsErr != nil {
+			return Todo{}, wsErr
+		}
+	}
+
+	if req.Priority != nil {
+		priority := normalizePriority(c.logger, *req.Priority)
+		req.Priority = &priority
+	}
+
+	todo, err := store.Update(ctx, c.owner, req.ID, TodoUpdate{
+		Text:     req.Text,
+		Priority: req.Priority,
+		Done:     req.Done,
+		Version:  req.Version,
+	})
+	if err != nil {
+		return Todo{}, c.storeError(ctx, req, "database_update_failed", err)
+	}
+
+	publishEvent(ctx, eventTodoUpdated, todo)
+
+	c.logger.Info("SUCCESS", "event", "todo_updated", "via", "websocket", "id", todo.ID,
+		"version", todo.Version, "text_length", len(todo.Text), "priority", todo.Priority,
+		"done", todo.Done, "text", textPreview(todo.Text))
+	return todo, nil
+}
+
+func (c *wsClient) delete(ctx context.Context, req wsRequest) (Todo, *wsError) {
+	if wsErr := c.checkTarget(req); wsErr != nil {
+		return Todo{}, wsErr
+	}
+
+	todo, err := store.Delete(ctx, c.owner, req.ID, req.Version)
+	if err != nil {
+		return Todo{}, c.storeError(ctx, req, "database_delete_failed", err)
+	}
+
+	publishEvent(ctx, eventTodoDeleted, todo)
+
+	c.logger.Info("SUCCESS", "event", "todo_deleted", "via", "websocket", "id", todo.ID,
+		"version", todo.Version)
+	return todo, nil
+}
+
+// checkTarget validates the todo ID and version of an update or delete
+func (c *wsClient) checkTarget(req wsRequest) *wsError {
+	if req.ID <= 0 {
+		c.logger.Warn("REJECT", "reason", "invalid_id", "id", req.ID)
+		return &wsError{code: codeInvalidID, message: "Invalid todo ID"}
+	}
+	if req.Version == nil {
+		c.logger.Warn("REJECT", "reason", "missing_version", "id", req.ID)
+		return &wsError{code: codeInvalidRequest, message: "version is required"}
+	}
+	return nil
+}
+
+// checkText applies the same validation and moderation as the HTTP API. id
+// is zero for new todos.
+func (c *wsClient) checkText(text string, id int) *wsError {
+	if reason, message := validateTodoText(text); reason != "" {
+		c.logger.Warn("REJECT", "reason", reason, "id", id, "length", len(text), "max", maxTodoLength,
+			"text_preview", textPreview(text))
+		if id == 0 {
+			todosRejectedTotal.WithLabelValues(reason).Inc()
+		}
+		return &wsError{code: codeFromReason(reason), message: message}
+	}
+
+	if rule, message := moderation.Check(text); rule != "" {
+		c.logger.Warn("REJECT", "reason", "moderation", "moderation_rule", rule, "id", id,
+			"text_preview", textPreview(text))
+		if id == 0 {
+			todosRejectedTotal.WithLabelValues("moderation").Inc()
+		}
+		return &wsError{code: codeModerationFailed, rule: rule, message: message}
+	}
+	return nil
+}
+
+// storeError turns a failed update or delete into the error sent back. A
+// version conflict carries the todo as it is now, so the client can retry
+// on top of it.
+func (c *wsClient) storeError(ctx context.Context, req wsRequest, event string, err error) *wsError {
+	switch {
+	case errors.Is(err, errTodoNotFound):
+		c.logger.Warn("REJECT", "reason", "todo_not_found", "id", req.ID)
+		return &wsError{code: codeTodoNotFound, message: "Todo not found"}
+
+	case errors.Is(err, errVersionConflict):
+		c.logger.Warn("REJECT", "reason", "version_conflict", "id", req.ID, "version", *req.Version)
+		wsErr := &wsError{code: codeVersionConflict, message: "Todo was changed by someone else"}
+		if current, err := store.Get(ctx, c.owner, req.ID); err == nil {
+			wsErr.todo = &current
+		} else if errors.Is(err, errTodoNotFound) {
+			// Deleted right after the conflicting change
+			return &wsError{code: codeTodoNotFound, message: "Todo not found"}
+		}
+		return wsErr
+
+	default:
+		c.logger.Error("ERROR", "event", event, "id", req.ID, "error", err)
+		return &wsError{code: codeInternal, message: "Internal server error"}
+	}
+}
+
+// subscribe starts pushing todo changes to the client, after replaying the
+// ones missed since req.LastEventID
+func (c *wsClient) subscribe(req wsRequest) {
+	if c.subscribed {
+		c.sendError(req.Ref, &wsError{code: codeInvalidRequest, message: "Already subscribed"})
+		return
+	}
+	c.subscribed = true
+
+	events, missed, resumed, position := todoStream.Subscribe(c.owner, req.LastEventID)
+	go func() {
+		<-c.done
+		todoStream.Unsubscribe(events)
+	}()
+
+	c.send(wsMessage{Type: "ack", Ref: req.Ref, EventID: position})
+	if req.LastEventID != "" && !resumed {
+		c.send(wsMessage{Type: "reset", EventID: position})
+	}
+	for _, event := range missed {
+		c.sendEvent(event)
+	}
+
+	c.logger.Info("WS", "event", "subscribed", "last_event_id", req.LastEventID,
+		"resumed", resumed, "replayed", len(missed))
+
+	go func() {
+		for event := range events {
+			if c.sendEvent(event) != nil {
+				c.conn.Close()
+				return
+			}
+		}
+
+		// The hub dropped the subscription, because the server is shutting
+		// down or the client fell behind
+		select {
+		case <-c.done:
+		default:
+			if shuttingDown.Load() {
+				c.close(websocket.CloseGoingAway, "server shutting down")
+			} else {
+				c.close(websocket.CloseTryAgainLater, "subscription ended, resubscribe with last_event_id")
+			}
+		}
+	}()
+}
+
+func (c *wsClient) sendEvent(event streamEvent) error {
+	return c.send(wsMessage{
+		Type:    "event",
+		Event:   event.Type,
+		EventID: todoStream.eventID(event.Seq),
+		Todo:    event.Data,
+	})
+}
+
+func (c *wsClient) sendError(ref string, wsErr *wsError) {
+	msg := wsMessage{Type: "error", Ref: ref, Error: wsErr.code, Rule: wsErr.rule, Message: wsErr.message}
+	if wsErr.todo != nil {
+		msg.Version = wsErr.todo.Version
+		msg.Todo, _ = json.Marshal(wsErr.todo)
+	}
+	c.send(msg)
+}
+
+func (c *wsClient) send(msg wsMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(msg)
+}
+
+// close sends a close frame and closes the connection, which ends the read
+// loop
+func (c *wsClient) close(code int, reason string) {
+	c.writeMu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(wsWriteTimeout))
+	c.writeMu.Unlock()
+	c.conn.Close()
+}
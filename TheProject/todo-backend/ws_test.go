@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebSocket connects to GET /ws of api
+func dialWebSocket(t *testing.T, api *testAPI) *websocket.Conn {
+	t.Helper()
+
+	server := httptest.NewServer(api.mux)
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWebSocketErrorCodes(t *testing.T) {
+	api := newTestAPI(t)
+	conn := dialWebSocket(t, api)
+	todo := api.createTodo("Shared")
+
+	// request sends a raw message and returns the reply to it
+	request := func(msg string) wsMessage {
+		t.Helper()
+
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply wsMessage
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	tests := []struct {
+		name string
+		msg  string
+		code errorCode
+	}{
+		{"invalid JSON", `{"type":`, codeInvalidJSON},
+		{"unknown type", `{"type":"rename","ref":"r"}`, codeInvalidRequest},
+		{"empty text", `{"type":"create","ref":"r","text":""}`, codeEmptyText},
+		{"text too long", `{"type":"create","ref":"r","text":"` + strings.Repeat("x", maxTodoLength+1) + `"}`, codeTextTooLong},
+		{"invalid ID", `{"type":"delete","ref":"r","version":1}`, codeInvalidID},
+		{"missing version", `{"type":"delete","ref":"r","id":1}`, codeInvalidRequest},
+		{"nothing to update", `{"type":"update","ref":"r","id":1,"version":1}`, codeInvalidRequest},
+		{"unknown todo", `{"type":"delete","ref":"r","id":42,"version":1}`, codeTodoNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := request(tt.msg)
+			if reply.Type != "error" || reply.Error != tt.code {
+				t.Fatalf("reply = %+v, want error %s", reply, tt.code)
+			}
+		})
+	}
+
+	// A stale version gets the todo as it is now
+	reply := request(`{"type":"update","ref":"u1","id":` + strconv.Itoa(todo.ID) + `,"version":1,"done":true}`)
+	if reply.Type != "ack" || reply.Version != 2 {
+		t.Fatalf("update reply = %+v, want an ack at version 2", reply)
+	}
+	reply = request(`{"type":"update","ref":"u2","id":` + strconv.Itoa(todo.ID) + `,"version":1,"text":"Stale"}`)
+	if reply.Error != codeVersionConflict || reply.Ref != "u2" || reply.Version != 2 || len(reply.Todo) == 0 {
+		t.Fatalf("conflict reply = %+v, want %s carrying version 2", reply, codeVersionConflict)
+	}
+}
+
+func TestWebSocketRequiresWriteScope(t *testing.T) {
+	api := newTestAPI(t)
+	t.Setenv("PUBLIC_BOARD", "read")
+	conn := dialWebSocket(t, api)
+
+	conn.WriteJSON(map[string]string{"type": "create", "ref": "c1", "text": "Anonymous"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply wsMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error != codeInsufficientScope || reply.Ref != "c1" {
+		t.Fatalf("reply = %+v, want %s", reply, codeInsufficientScope)
+	}
+}
@@ -28,17 +28,23 @@ JSON_PAYLOAD=$(cat <<EOF
 EOF
 )
 
+# Authenticate with the API key from the todo-api-keys Secret
+if [ -z "$TODO_API_KEY" ]; then
+    echo "Error: TODO_API_KEY is not set"
+    exit 1
+fi
+
 # Send POST request to todo-backend
-RESPONSE=$(curl -s -X POST \
+if RESPONSE=$(curl -s --fail-with-body -X POST \
     -H "Content-Type: application/json" \
+    -H "Authorization: Bearer $TODO_API_KEY" \
     -d "$JSON_PAYLOAD" \
-    "http://todo-backend-service.project.svc.cluster.local:3001/todos")
-
-if [ $? -eq 0 ]; then
+    "http://todo-backend-service.project.svc.cluster.local:3001/todos"); then
     echo "Successfully created todo!"
     echo "Response: $RESPONSE"
 else
     echo "Error: Failed to create todo"
+    echo "Response: $RESPONSE"
     exit 1
 fi
 